@@ -0,0 +1,172 @@
+package autodns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	acmeCheckPrefix  = "_acme-check."
+	acmeCheckTimeout = 2 * time.Second
+)
+
+// parseAcmeCheckQuery parses _acme-check.<digest>[.<host>].<zone>.
+func parseAcmeCheckQuery(qname, zone string) (digest, hostLabel string, ok bool) {
+	if len(qname) < len(acmeCheckPrefix) || !strings.EqualFold(qname[:len(acmeCheckPrefix)], acmeCheckPrefix) {
+		return "", "", false
+	}
+	return parseAcmeRegQuery(acmeRegPrefix+qname[len(acmeCheckPrefix):], zone)
+}
+
+// zoneNameservers returns the NS hosts of the zone apex record.
+func (autodns *Autodns) zoneNameservers(zone string) ([]string, error) {
+	record, err := autodns.readRecordField(zone, "@")
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0, len(record.NS))
+	for _, ns := range record.NS {
+		hosts = append(hosts, dns.Fqdn(strings.ToLower(ns.Host)))
+	}
+	return hosts, nil
+}
+
+// nameserverAddrs resolves a nameserver host, preferring in-zone A/AAAA records
+// so glue-only nameservers work without a recursive resolver.
+func (autodns *Autodns) nameserverAddrs(ctx context.Context, zone, host string) ([]string, error) {
+	if host == zone || strings.HasSuffix(host, "."+zone) {
+		label := "@"
+		if host != zone {
+			label = strings.TrimSuffix(host, "."+zone)
+		}
+		record, err := autodns.readRecordField(zone, label)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(record.A)+len(record.AAAA))
+		for _, a := range record.A {
+			addrs = append(addrs, a.Ip.String())
+		}
+		for _, aaaa := range record.AAAA {
+			addrs = append(addrs, aaaa.Ip.String())
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
+// nameserverServes reports whether every address of host answers the
+// challenge name with digest; the CA may query any of them.
+func (autodns *Autodns) nameserverServes(ctx context.Context, zone, host, name, digest string) bool {
+	addrs, err := autodns.nameserverAddrs(ctx, zone, host)
+	if err != nil {
+		logger.Warning(`ACME check could not resolve nameserver `, host, ` error: `, err)
+		return false
+	}
+	if len(addrs) == 0 {
+		return false
+	}
+	port := autodns.acmeCheckPort
+	if port == "" {
+		port = "53"
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	m.RecursionDesired = false
+	for _, addr := range addrs {
+		if !addressServes(ctx, m, net.JoinHostPort(addr, port), digest) {
+			return false
+		}
+	}
+	return true
+}
+
+func addressServes(ctx context.Context, m *dns.Msg, addr, digest string) bool {
+	c := &dns.Client{Timeout: acmeCheckTimeout}
+	resp, _, err := c.ExchangeContext(ctx, m, addr)
+	if err == nil && resp.Truncated {
+		c.Net = "tcp"
+		resp, _, err = c.ExchangeContext(ctx, m, addr)
+	}
+	if err != nil {
+		return false
+	}
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingNameservers queries every NS of the zone in parallel and returns the
+// ones not serving digest yet.
+func (autodns *Autodns) pendingNameservers(ctx context.Context, zone, hostLabel, digest string) ([]string, error) {
+	hosts, err := autodns.zoneNameservers(zone)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("zone %s has no NS records", zone)
+	}
+	name := acmePublicName(zone, hostLabel)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		pending []string
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if !autodns.nameserverServes(ctx, zone, host, name, digest) {
+				mu.Lock()
+				pending = append(pending, strings.TrimSuffix(host, "."))
+				mu.Unlock()
+			}
+		}(host)
+	}
+	wg.Wait()
+	sort.Strings(pending)
+	return pending, nil
+}
+
+func (autodns *Autodns) handleAcmeCheck(ctx context.Context, qname, zone, clientIP string, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
+	if !autodns.acmeAllowed(net.ParseIP(clientIP)) {
+		logger.Warning(`ACME check request for `, qname, ` from `, clientIP, ` not in acme networks`)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotAllowed, nil)
+	}
+	digest, hostLabel, ok := parseAcmeCheckQuery(qname, zone)
+	if !ok || (hostLabel != "" && !isAcmeHostLabel(hostLabel)) {
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 2*acmeCheckTimeout)
+	defer cancel()
+	pending, err := autodns.pendingNameservers(ctx, zone, hostLabel, digest)
+	if err != nil {
+		logger.Error(`Error checking ACME propagation for `, qname, ` error: `, err)
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, edeNotReady, err)
+	}
+
+	reply := []string{"ok"}
+	if len(pending) > 0 {
+		reply = append([]string{"pending"}, pending...)
+	}
+	if _, err := autodns.TXTReply(qname, reply, r, state, w); err != nil {
+		logger.Error(`Error sending ACME check reply for `, qname, ` error: `, err)
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, nil, err)
+	}
+	return dns.RcodeSuccess, nil
+}
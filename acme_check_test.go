@@ -0,0 +1,138 @@
+package autodns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startStandIn serves handler on addr over UDP and returns the bound port.
+func startStandIn(t *testing.T, addr string, handler dns.Handler) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: handler}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	return port
+}
+
+func TestParseAcmeCheckQuery(t *testing.T) {
+	digest, host, ok := parseAcmeCheckQuery("_acme-check."+testAcmeDigest+".host1.example.net.", exampleZone)
+	if !ok || digest != testAcmeDigest || host != "host1" {
+		t.Fatalf("got (%q, %q, %v)", digest, host, ok)
+	}
+	if _, host, ok = parseAcmeCheckQuery("_acme-check."+testAcmeDigest+".example.net.", exampleZone); !ok || host != "" {
+		t.Fatalf("apex: host %q ok %v", host, ok)
+	}
+	if _, _, ok = parseAcmeCheckQuery("_acme-reg."+testAcmeDigest+".example.net.", exampleZone); ok {
+		t.Fatal("other prefix must not parse")
+	}
+}
+
+func TestAcmeCheckPropagation(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	mr.HSet(zoneKey, "@", `{"ns":[{"ttl":300,"host":"ns1.example.net."},{"ttl":300,"host":"ns2.example.net."}]}`)
+	mr.HSet(zoneKey, "ns1", `{"a":[{"ttl":300,"ip":"127.0.0.1"}]}`)
+	mr.HSet(zoneKey, "ns2", `{"a":[{"ttl":300,"ip":"127.0.0.2"},{"ttl":300,"ip":"127.0.0.3"}]}`)
+
+	// ns1 is this plugin, ns2 a secondary with two addresses that each only
+	// serve the digest once synced.
+	port := startStandIn(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_, _ = a.ServeDNS(context.Background(), w, r)
+	}))
+	secondary := func(synced *atomic.Bool) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if synced.Load() {
+				m.Answer = append(m.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{testAcmeDigest},
+				})
+			}
+			_ = w.WriteMsg(m)
+		})
+	}
+	var synced, syncedStale atomic.Bool
+	startStandIn(t, "127.0.0.2:"+port, secondary(&synced))
+	startStandIn(t, "127.0.0.3:"+port, secondary(&syncedStale))
+	a.acmeCheckPort = port
+
+	check := func() []string {
+		t.Helper()
+		resp := serveDNS(t, a, "100.64.0.10", "_acme-check."+testAcmeDigest+".host1."+exampleZone, dns.TypeTXT)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Fatalf("rcode = %d, answer = %v", resp.Rcode, resp.Answer)
+		}
+		return resp.Answer[0].(*dns.TXT).Txt
+	}
+
+	if got := check(); strings.Join(got, " ") != "pending ns1.example.net ns2.example.net" {
+		t.Fatalf("before publish = %q", got)
+	}
+	if resp := serveDNS(t, a, "100.64.0.10", "_acme-reg."+testAcmeDigest+".host1."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("publish rcode = %d", resp.Rcode)
+	}
+	if got := check(); strings.Join(got, " ") != "pending ns2.example.net" {
+		t.Fatalf("after publish = %q", got)
+	}
+	synced.Store(true)
+	if got := check(); strings.Join(got, " ") != "pending ns2.example.net" {
+		t.Fatalf("with one address synced = %q", got)
+	}
+	syncedStale.Store(true)
+	if got := check(); strings.Join(got, " ") != "ok" {
+		t.Fatalf("after sync = %q", got)
+	}
+}
+
+func TestAcmeCheckRequestContext(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	mr.HSet(zoneKey, "@", `{"ns":[{"ttl":300,"host":"ns1.example.net."}]}`)
+	mr.HSet(zoneKey, "ns1", `{"a":[{"ttl":300,"ip":"127.0.0.1"}]}`)
+	a.acmeCheckPort = startStandIn(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_, _ = a.ServeDNS(context.Background(), w, r)
+	}))
+	if resp := serveDNS(t, a, "100.64.0.10", "_acme-reg."+testAcmeDigest+"."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("publish rcode = %d", resp.Rcode)
+	}
+
+	// A request whose context is already done must not reach the nameservers.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := newRecorderWithIP(t, "100.64.0.10")
+	m := new(dns.Msg)
+	m.SetQuestion("_acme-check."+testAcmeDigest+"."+exampleZone, dns.TypeTXT)
+	if _, err := a.ServeDNS(ctx, rec, m); err != nil {
+		t.Fatalf("ServeDNS error: %v", err)
+	}
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Fatalf("answer = %v", rec.Msg)
+	}
+	if got := rec.Msg.Answer[0].(*dns.TXT).Txt; strings.Join(got, " ") != "pending ns1.example.net" {
+		t.Fatalf("canceled check = %q", got)
+	}
+}
+
+func TestAcmeCheckAccess(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, "@", `{"soa":{"ttl":300,"mbox":"hostmaster.example.net.","ns":"ns1.example.net."}}`)
+	resp := serveDNS(t, a, "8.8.8.8", "_acme-check."+testAcmeDigest+"."+exampleZone, dns.TypeTXT)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %d, want NXDOMAIN outside acme networks", resp.Rcode)
+	}
+	resp = serveDNSFailing(t, a, "100.64.0.10", "_acme-check."+testAcmeDigest+"."+exampleZone, dns.TypeTXT, true)
+	if ede := extendedErrorOf(resp); resp.Rcode != dns.RcodeServerFailure || ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNotReady {
+		t.Fatalf("rcode = %d, EDE = %v, want SERVFAIL with Not Ready without NS records", resp.Rcode, ede)
+	}
+}
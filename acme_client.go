@@ -0,0 +1,358 @@
+package autodns
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	certStoreKey       = "_autodns:certs"
+	certAccountKey     = "_autodns:acme-account"
+	certRenewBefore    = 30 * 24 * time.Hour
+	certCheckInterval  = 12 * time.Hour
+	certIssueTimeout   = 10 * time.Minute
+	certChallengeField = "acme.certificate"
+	certLockKey        = "_autodns:certlock:"
+	certLockTTL        = certIssueTimeout + time.Minute
+)
+
+// StoredCertificate is the JSON stored per certificate in the certificate hash.
+type StoredCertificate struct {
+	Names       []string `json:"names"`
+	Certificate string   `json:"certificate"`
+	Key         string   `json:"key"`
+	NotAfter    int64    `json:"not_after"`
+}
+
+func (cert *StoredCertificate) needsRenewal(now time.Time) bool {
+	return cert == nil || now.Add(certRenewBefore).After(time.Unix(cert.NotAfter, 0))
+}
+
+func (autodns *Autodns) certKey() string {
+	return autodns.keyPrefix + certStoreKey + autodns.keySuffix
+}
+
+func (autodns *Autodns) certAccountKey() string {
+	return autodns.keyPrefix + certAccountKey + autodns.keySuffix
+}
+
+// certUnlockScript deletes a certificate lock only while it still holds the
+// token of the instance that took it.
+var certUnlockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// lockCertificate takes the per-certificate lock shared by every instance on
+// the same redis, so only one of them orders it. ok is false while another
+// instance holds it; the lock expires on its own after certLockTTL.
+func (autodns *Autodns) lockCertificate(name string) (unlock func(), ok bool, err error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(buf)
+	key := autodns.keyPrefix + certLockKey + name + autodns.keySuffix
+
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+	_, err = redis.String(conn.Do("SET", key, token, "NX", "PX", certLockTTL.Milliseconds()))
+	if err == redis.ErrNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return func() {
+		conn := autodns.Pool.Get()
+		defer conn.Close()
+		if _, err := certUnlockScript.Do(conn, key, token); err != nil {
+			logger.Error(`Error releasing certificate lock for `, name, ` error: `, err)
+		}
+	}, true, nil
+}
+
+// LoadCertificate returns the stored certificate whose first name is name, or nil.
+func (autodns *Autodns) LoadCertificate(name string) (*StoredCertificate, error) {
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+
+	val, err := redis.String(conn.Do("HGET", autodns.certKey(), name))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert := new(StoredCertificate)
+	if err := json.Unmarshal([]byte(val), cert); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func (autodns *Autodns) saveCertificate(cert *StoredCertificate) error {
+	payload, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", autodns.certKey(), cert.Names[0], payload)
+	return err
+}
+
+// accountSigner loads the ACME account key from redis, creating it on first use.
+func (autodns *Autodns) accountSigner() (crypto.Signer, error) {
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+
+	field := autodns.AcmeDirectory
+	val, err := redis.Bytes(conn.Do("HGET", autodns.certAccountKey(), field))
+	if err == nil {
+		block, _ := pem.Decode(val)
+		if block == nil {
+			return nil, errors.New("invalid acme account key in redis")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != redis.ErrNil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if _, err := conn.Do("HSET", autodns.certAccountKey(), field, keyPEM); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (autodns *Autodns) acmeClient(ctx context.Context) (*acme.Client, error) {
+	key, err := autodns.accountSigner()
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{Key: key, DirectoryURL: autodns.AcmeDirectory, HTTPClient: autodns.certHTTPClient}
+	account := &acme.Account{}
+	if autodns.AcmeEmail != "" {
+		account.Contact = []string{"mailto:" + autodns.AcmeEmail}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+	return client, nil
+}
+
+// challengeTarget maps a certificate name to the autodns zone and ACME host label.
+func (autodns *Autodns) challengeTarget(name string) (zone, hostLabel string, err error) {
+	fqdn := UniformZone(strings.TrimPrefix(name, "*."))
+	zone = plugin.Zones(autodns.zones()).Matches(fqdn)
+	if zone == "" {
+		return "", "", fmt.Errorf("%s is not in an autodns zone", name)
+	}
+	if fqdn != zone {
+		hostLabel = strings.TrimSuffix(fqdn, "."+zone)
+	}
+	return zone, hostLabel, nil
+}
+
+// RenewCertificates issues every configured certificate that is missing or close to expiry.
+func (autodns *Autodns) RenewCertificates(ctx context.Context) {
+	for _, names := range autodns.AcmeCertificates {
+		issued, err := autodns.renewCertificate(ctx, names)
+		if err != nil {
+			logger.Error(`Error issuing certificate for `, strings.Join(names, ","), ` error: `, err)
+			continue
+		}
+		if issued {
+			logger.Info(`Issued certificate for `, strings.Join(names, ","))
+		}
+	}
+}
+
+// renewCertificate orders names under the certificate lock when the stored
+// certificate needs renewal. The stored one is checked again once the lock is
+// held, as another instance may have just renewed it.
+func (autodns *Autodns) renewCertificate(ctx context.Context, names []string) (bool, error) {
+	stored, err := autodns.LoadCertificate(names[0])
+	if err != nil || !stored.needsRenewal(time.Now()) {
+		return false, err
+	}
+	unlock, ok, err := autodns.lockCertificate(names[0])
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		logger.Info(`Certificate for `, strings.Join(names, ","), ` is being issued by another instance`)
+		return false, nil
+	}
+	defer unlock()
+
+	stored, err = autodns.LoadCertificate(names[0])
+	if err != nil || !stored.needsRenewal(time.Now()) {
+		return false, err
+	}
+	issueCtx, cancel := context.WithTimeout(ctx, certIssueTimeout)
+	defer cancel()
+	if err := autodns.issueCertificate(issueCtx, names); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (autodns *Autodns) issueCertificate(ctx context.Context, names []string) error {
+	client, err := autodns.acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := autodns.solveAuthorization(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return err
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return autodns.saveCertificate(&StoredCertificate{
+		Names:       names,
+		Certificate: string(certPEM),
+		Key:         string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		NotAfter:    leaf.NotAfter.Unix(),
+	})
+}
+
+func (autodns *Autodns) solveAuthorization(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	digest, err := client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+	zone, hostLabel, err := autodns.challengeTarget(authz.Identifier.Value)
+	if err != nil {
+		return err
+	}
+	if err := autodns.publishAcmeDigest(zone, hostLabel, digest, certChallengeField); err != nil {
+		return err
+	}
+	defer func() {
+		if err := autodns.RemoveAcmeTXTDigest(zone, acmeRedisField(hostLabel), digest); err != nil {
+			logger.Error(`Error removing ACME digest for `, authz.Identifier.Value, ` error: `, err)
+		}
+	}()
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+func (autodns *Autodns) startCertificates() error {
+	autodns.certStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-stop
+			cancel()
+		}()
+
+		autodns.RenewCertificates(ctx)
+		ticker := time.NewTicker(certCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				autodns.RenewCertificates(ctx)
+			}
+		}
+	}(autodns.certStop)
+	return nil
+}
+
+func (autodns *Autodns) stopCertificates() error {
+	if autodns.certStop != nil {
+		close(autodns.certStop)
+		autodns.certStop = nil
+	}
+	return nil
+}
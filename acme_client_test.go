@@ -0,0 +1,212 @@
+package autodns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestStoredCertificateNeedsRenewal(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		cert *StoredCertificate
+		want bool
+	}{
+		{name: "missing", cert: nil, want: true},
+		{name: "fresh", cert: &StoredCertificate{NotAfter: now.Add(60 * 24 * time.Hour).Unix()}, want: false},
+		{name: "inside renewal window", cert: &StoredCertificate{NotAfter: now.Add(10 * 24 * time.Hour).Unix()}, want: true},
+		{name: "expired", cert: &StoredCertificate{NotAfter: now.Add(-time.Hour).Unix()}, want: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.cert.needsRenewal(now); got != tc.want {
+				t.Fatalf("needsRenewal = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChallengeTarget(t *testing.T) {
+	a := &Autodns{}
+	a.setZones([]string{exampleZone})
+	tests := []struct {
+		name     string
+		wantZone string
+		wantHost string
+		wantErr  bool
+	}{
+		{name: "example.net", wantZone: exampleZone, wantHost: ""},
+		{name: "*.example.net", wantZone: exampleZone, wantHost: ""},
+		{name: "host1.example.net", wantZone: exampleZone, wantHost: "host1"},
+		{name: "*.sub.example.net", wantZone: exampleZone, wantHost: "sub"},
+		{name: "example.org", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			zone, host, err := a.challengeTarget(tc.name)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil || zone != tc.wantZone || host != tc.wantHost {
+				t.Fatalf("got (%q, %q, %v), want (%q, %q)", zone, host, err, tc.wantZone, tc.wantHost)
+			}
+		})
+	}
+}
+
+func TestAccountSignerPersisted(t *testing.T) {
+	a, _ := newTestAutodns(t)
+	a.AcmeDirectory = defaultAcmeDirectory
+
+	first, err := a.accountSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.accountSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Public().(*ecdsa.PublicKey).Equal(second.Public()) {
+		t.Fatal("account key must be reused from redis")
+	}
+}
+
+func TestRenewCertificateLock(t *testing.T) {
+	var orders atomic.Int32
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orders.Add(1)
+		http.Error(w, "no CA here", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(directory.Close)
+
+	a, mr := newTestAutodns(t)
+	a.AcmeDirectory = directory.URL
+	lockKey := a.keyPrefix + certLockKey + "example.net" + a.keySuffix
+
+	// another instance holds the lock
+	mr.Set(lockKey, "other")
+	if issued, err := a.renewCertificate(context.Background(), []string{"example.net"}); issued || err != nil {
+		t.Fatalf("renew while locked = %v, %v", issued, err)
+	}
+	if orders.Load() != 0 {
+		t.Fatal("certificate ordered while another instance holds the lock")
+	}
+
+	// our lock must not release one taken over by another instance
+	mr.Del(lockKey)
+	unlock, ok, err := a.lockCertificate("example.net")
+	if !ok || err != nil {
+		t.Fatalf("lock = %v, %v", ok, err)
+	}
+	if _, ok, _ := a.lockCertificate("example.net"); ok {
+		t.Fatal("lock taken twice")
+	}
+	mr.Set(lockKey, "other")
+	unlock()
+	if got, _ := mr.Get(lockKey); got != "other" {
+		t.Fatalf("lock = %q, want the other instance's token kept", got)
+	}
+
+	// the lock is taken and released around a real attempt
+	mr.Del(lockKey)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := a.renewCertificate(ctx, []string{"example.net"}); err == nil {
+		t.Fatal("expected error from the unreachable CA")
+	}
+	if orders.Load() == 0 {
+		t.Fatal("certificate not ordered with the lock free")
+	}
+	if mr.Exists(lockKey) {
+		t.Fatal("lock not released")
+	}
+}
+
+func TestAcmeCertificateSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.certificate example.net *.example.net
+		acme.certificate Host1.Example.Net.
+		acme.directory https://127.0.0.1:14000/dir
+		acme.email hostmaster@example.net
+	}`, mr.Addr()))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if len(a.AcmeCertificates) != 2 || len(a.AcmeCertificates[0]) != 2 || a.AcmeCertificates[1][0] != "host1.example.net" {
+		t.Fatalf("AcmeCertificates = %v", a.AcmeCertificates)
+	}
+	if a.AcmeDirectory != "https://127.0.0.1:14000/dir" || a.AcmeEmail != "hostmaster@example.net" {
+		t.Fatalf("directory/email = %q / %q", a.AcmeDirectory, a.AcmeEmail)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+	}`, mr.Addr()))
+	if a, err = redisSetup(c); err != nil || a.AcmeDirectory != defaultAcmeDirectory {
+		t.Fatalf("default directory = %q, err %v", a.AcmeDirectory, err)
+	}
+}
+
+// TestIssueCertificatePebble runs the DNS-01 flow against a local Pebble.
+// Start pebble with -dnsserver pointing at AUTODNS_PEBBLE_DNS, e.g.
+//
+//	AUTODNS_PEBBLE_DIRECTORY=https://127.0.0.1:14000/dir AUTODNS_PEBBLE_DNS=127.0.0.1:8053 go test -run Pebble
+func TestIssueCertificatePebble(t *testing.T) {
+	directory := os.Getenv("AUTODNS_PEBBLE_DIRECTORY")
+	dnsAddr := os.Getenv("AUTODNS_PEBBLE_DNS")
+	if directory == "" || dnsAddr == "" {
+		t.Skip("AUTODNS_PEBBLE_DIRECTORY and AUTODNS_PEBBLE_DNS not set")
+	}
+
+	a, _ := prepareServeDNS(t)
+	a.AcmeDirectory = directory
+	a.certHTTPClient = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	srv := &dns.Server{Addr: dnsAddr, Net: "udp", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		_, _ = a.ServeDNS(context.Background(), w, r)
+	})}
+	go func() { _ = srv.ListenAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	names := []string{"example.net", "*.example.net", "host1.example.net"}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	if err := a.issueCertificate(ctx, names); err != nil {
+		t.Fatalf("issueCertificate: %v", err)
+	}
+
+	stored, err := a.LoadCertificate("example.net")
+	if err != nil || stored == nil {
+		t.Fatalf("stored certificate = %v, err %v", stored, err)
+	}
+	block, _ := pem.Decode([]byte(stored.Certificate))
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.DNSNames) != len(names) {
+		t.Fatalf("DNSNames = %v, want %v", leaf.DNSNames, names)
+	}
+}
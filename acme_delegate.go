@@ -0,0 +1,115 @@
+package autodns
+
+import (
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// acmeDelegation maps a foreign domain whose _acme-challenge is a CNAME to a
+// target name inside an autodns zone.
+type acmeDelegation struct {
+	Domain   string
+	Target   string
+	Networks []net.IPNet
+}
+
+func (autodns *Autodns) matchAcmeDelegation(qname string) *acmeDelegation {
+	if !strings.HasPrefix(qname, acmeRegPrefix) && !strings.HasPrefix(qname, acmeDelPrefix) {
+		return nil
+	}
+	for i := range autodns.AcmeDelegations {
+		if strings.HasSuffix(qname, "."+autodns.AcmeDelegations[i].Domain) {
+			return &autodns.AcmeDelegations[i]
+		}
+	}
+	return nil
+}
+
+func (autodns *Autodns) delegationNetworks(d *acmeDelegation) []net.IPNet {
+	if len(d.Networks) > 0 {
+		return d.Networks
+	}
+	return autodns.acmeNetworks()
+}
+
+// delegationField returns the zone and hash field that hold the delegated digests.
+func (autodns *Autodns) delegationField(d *acmeDelegation) (zone, field string, ok bool) {
+	zone = plugin.Zones(autodns.zones()).Matches(d.Target)
+	if zone == "" || zone == d.Target {
+		return "", "", false
+	}
+	return zone, strings.TrimSuffix(d.Target, "."+zone), true
+}
+
+// isDelegatedAcmeField reports whether field holds digests for an acme.delegate target.
+func (autodns *Autodns) isDelegatedAcmeField(zone, field string) bool {
+	for i := range autodns.AcmeDelegations {
+		z, f, ok := autodns.delegationField(&autodns.AcmeDelegations[i])
+		if ok && z == zone && f == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (autodns *Autodns) handleAcmeDelegation(d *acmeDelegation, qname, clientIP string, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
+	lower := strings.ToLower(qname)
+	register := strings.HasPrefix(lower, acmeRegPrefix)
+
+	if !IPBelongsToRegisterNetworks(net.ParseIP(clientIP), autodns.delegationNetworks(d)) {
+		logger.Warning(`ACME delegation request for `, qname, ` from `, clientIP, ` not in networks of `, d.Domain)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, d.Domain, dns.RcodeRefused, edeNotAllowed, nil)
+	}
+	zone, field, ok := autodns.delegationField(d)
+	if !ok {
+		logger.Error(`ACME delegation target `, d.Target, ` is not inside a served zone`)
+		return autodns.errorResponse(*state, d.Domain, dns.RcodeServerFailure, nil, nil)
+	}
+
+	var (
+		digest, hostLabel string
+		err               error
+	)
+	if register {
+		digest, hostLabel, ok = parseAcmeRegQuery(qname, d.Domain)
+	} else {
+		digest, hostLabel, ok = parseAcmeDelQuery(qname, d.Domain)
+	}
+	if !ok || hostLabel != "" {
+		return autodns.errorResponse(*state, d.Domain, dns.RcodeNameError, nil, nil)
+	}
+
+	reply := strings.TrimSuffix(d.Target, ".")
+	switch {
+	case register:
+		logger.Info(`ACME delegated registration for `, d.Domain, ` stored at `, d.Target, ` from `, clientIP)
+		if err = autodns.AddAcmeTXTRecord(zone, field, digest); err == nil {
+			autodns.stats.acmePublished.Add(1)
+		}
+	case digest != "":
+		logger.Info(`ACME delegated digest removal for `, d.Domain, ` at `, d.Target, ` from `, clientIP)
+		err = autodns.RemoveAcmeTXTDigest(zone, field, digest)
+		reply = "deleted"
+	default:
+		logger.Info(`ACME delegated deletion for `, d.Domain, ` at `, d.Target, ` from `, clientIP)
+		err = autodns.DeleteAcmeTXTRecord(zone, field)
+		reply = "deleted"
+	}
+	if err != nil {
+		logger.Error(`Error updating delegated ACME record `, d.Target, ` error: `, err)
+		return autodns.errorResponse(*state, d.Domain, dns.RcodeServerFailure, edeNotReady, err)
+	}
+	if !register {
+		autodns.stats.acmeDeleted.Add(1)
+	}
+
+	if _, err := autodns.TXTReply(qname, []string{reply}, r, state, w); err != nil {
+		return autodns.errorResponse(*state, d.Domain, dns.RcodeServerFailure, nil, err)
+	}
+	return dns.RcodeSuccess, nil
+}
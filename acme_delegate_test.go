@@ -0,0 +1,145 @@
+package autodns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func delegationAutodns(t *testing.T) (*Autodns, *miniredis.Miniredis) {
+	t.Helper()
+	a, mr := acmeAutodns(t)
+	a.AcmeDelegations = []acmeDelegation{
+		{Domain: "shop.com.", Target: "shop-com.acme." + exampleZone, Networks: mustParseCIDRs(t, "10.0.0.0/8")},
+		{Domain: "blog.org.", Target: "blog-org.acme." + exampleZone},
+	}
+	return a, mr
+}
+
+func TestAcmeDelegationPublish(t *testing.T) {
+	a, mr := delegationAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	resp := serveDNS(t, a, "10.1.2.3", "_acme-reg."+testAcmeDigest+".shop.com.", dns.TypeTXT)
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %d, want success", resp.Rcode)
+	}
+	if got := strings.Join(resp.Answer[0].(*dns.TXT).Txt, ""); got != "shop-com.acme.example.net" {
+		t.Fatalf("reply = %q", got)
+	}
+	if stored := mr.HGet(zoneKey, "shop-com.acme"); !strings.Contains(stored, testAcmeDigest) {
+		t.Fatalf("redis = %q, want digest under delegated label", stored)
+	}
+
+	public := serveDNS(t, a, "8.8.8.8", "shop-com.acme."+exampleZone, dns.TypeTXT)
+	tc := test.Case{
+		Qname:  "shop-com.acme." + exampleZone,
+		Qtype:  dns.TypeTXT,
+		Answer: []dns.RR{test.TXT(`shop-com.acme.example.net. 120 IN TXT "` + testAcmeDigest + `"`)},
+	}
+	if err := test.SortAndCheck(public, tc); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcmeDelegationAccess(t *testing.T) {
+	a, mr := delegationAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	t.Run("outside per-domain networks", func(t *testing.T) {
+		resp := serveDNS(t, a, "100.64.0.10", "_acme-reg."+testAcmeDigest+".shop.com.", dns.TypeTXT)
+		if resp.Rcode != dns.RcodeRefused {
+			t.Fatalf("rcode = %d, want REFUSED", resp.Rcode)
+		}
+		if stored := mr.HGet(zoneKey, "shop-com.acme"); stored != "" {
+			t.Fatalf("denied request wrote redis: %q", stored)
+		}
+	})
+
+	t.Run("falls back to acme networks", func(t *testing.T) {
+		if resp := serveDNS(t, a, "100.64.0.10", "_acme-reg."+testAcmeDigest+".blog.org.", dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %d, want success", resp.Rcode)
+		}
+		if resp := serveDNS(t, a, "10.1.2.3", "_acme-reg."+testAcmeDigest+".blog.org.", dns.TypeTXT); resp.Rcode != dns.RcodeRefused {
+			t.Fatalf("rcode = %d, want REFUSED outside acme.network", resp.Rcode)
+		}
+	})
+
+	t.Run("subdomain of foreign domain", func(t *testing.T) {
+		resp := serveDNS(t, a, "10.1.2.3", "_acme-reg."+testAcmeDigest+".www.shop.com.", dns.TypeTXT)
+		if resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("rcode = %d, want NXDOMAIN", resp.Rcode)
+		}
+	})
+}
+
+func TestAcmeDelegationDelete(t *testing.T) {
+	a, mr := delegationAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	for _, d := range []string{testAcmeDigest, testAcmeDigest2} {
+		if resp := serveDNS(t, a, "10.1.2.3", "_acme-reg."+d+".shop.com.", dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("publish rcode = %d", resp.Rcode)
+		}
+	}
+	if resp := serveDNS(t, a, "10.1.2.3", "_acme-del."+testAcmeDigest+".shop.com.", dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("digest delete rcode = %d", resp.Rcode)
+	}
+	if stored := mr.HGet(zoneKey, "shop-com.acme"); strings.Contains(stored, testAcmeDigest+`"`) || !strings.Contains(stored, testAcmeDigest2) {
+		t.Fatalf("redis = %q after single digest delete", stored)
+	}
+	if resp := serveDNS(t, a, "10.1.2.3", "_acme-del.shop.com.", dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("delete rcode = %d", resp.Rcode)
+	}
+	if stored := mr.HGet(zoneKey, "shop-com.acme"); stored != "" {
+		t.Fatalf("redis = %q, want field deleted", stored)
+	}
+}
+
+func TestAcmeDeleteApex(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	if resp := serveDNS(t, a, "100.64.0.10", "_acme-reg."+testAcmeDigest+"."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("publish rcode = %d", resp.Rcode)
+	}
+	if resp := serveDNS(t, a, "100.64.0.10", "_acme-del."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("apex delete rcode = %d", resp.Rcode)
+	}
+	if stored := mr.HGet(zoneKey, "_acme-challenge"); stored != "" {
+		t.Fatalf("redis = %q, want apex challenge deleted", stored)
+	}
+}
+
+func TestAcmeDelegateSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.delegate Shop.com shop-com.acme.example.net 10.0.0.0/8 fd00::/8
+		acme.delegate blog.org blog-org.acme.example.net
+	}`, mr.Addr()))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if len(a.AcmeDelegations) != 2 {
+		t.Fatalf("AcmeDelegations = %v", a.AcmeDelegations)
+	}
+	d := a.AcmeDelegations[0]
+	if d.Domain != "shop.com." || d.Target != "shop-com.acme.example.net." || len(d.Networks) != 2 {
+		t.Fatalf("delegation = %+v", d)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.delegate shop.com
+	}`, mr.Addr()))
+	if _, err := redisSetup(c); err == nil {
+		t.Fatal("expected error without target")
+	}
+}
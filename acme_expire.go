@@ -0,0 +1,142 @@
+package autodns
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const acmeChallengeField = "_acme-challenge"
+
+// acmeExpired reports whether a published ACME digest is older than acme.expire.
+// Digests without a publish timestamp never expire.
+func (autodns *Autodns) acmeExpired(txt TXT_Record, now time.Time) bool {
+	if autodns.AcmeExpire <= 0 || txt.Published == 0 {
+		return false
+	}
+	return now.Sub(time.Unix(txt.Published, 0)) >= autodns.AcmeExpire
+}
+
+func (autodns *Autodns) dropExpiredAcme(txts []TXT_Record, now time.Time) []TXT_Record {
+	out := make([]TXT_Record, 0, len(txts))
+	for _, t := range txts {
+		if !autodns.acmeExpired(t, now) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func isAcmeChallengeField(field string) bool {
+	return field == acmeChallengeField || strings.HasPrefix(field, acmeChallengeField+".")
+}
+
+// CleanupExpiredAcme drops expired digests from every _acme-challenge* field
+// and deletes fields whose digests have all expired.
+func (autodns *Autodns) CleanupExpiredAcme() {
+	if autodns.AcmeExpire <= 0 {
+		return
+	}
+	now := time.Now()
+	for _, zone := range autodns.zones() {
+		fields, err := autodns.zoneFields(zone)
+		if err != nil {
+			logger.Error(`Error listing fields of `, zone, ` for ACME cleanup: `, err)
+			continue
+		}
+		for _, field := range fields {
+			if !isAcmeChallengeField(field) && !autodns.isDelegatedAcmeField(zone, field) {
+				continue
+			}
+			if err := autodns.expireAcmeField(zone, field, now); err != nil {
+				logger.Error(`Error cleaning up ACME record `, field, ` error: `, err)
+			}
+		}
+	}
+}
+
+// expireAcmeField drops the expired digests of one field. The field is only
+// rewritten if it still holds what was read, so a digest published meanwhile
+// is kept; the next cleanup picks up where this one gave way.
+func (autodns *Autodns) expireAcmeField(zone, field string, now time.Time) error {
+	conn := autodns.Pool.Get()
+	old, err := redis.String(conn.Do("HGET", autodns.keyPrefix+zone+autodns.keySuffix, field))
+	conn.Close()
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return autodns.replaceExpiredAcme(zone, field, old, now)
+}
+
+func (autodns *Autodns) replaceExpiredAcme(zone, field, old string, now time.Time) error {
+	record := new(Record)
+	if err := json.Unmarshal([]byte(old), record); err != nil {
+		return err
+	}
+	remaining := autodns.dropExpiredAcme(record.TXT, now)
+	if len(remaining) == len(record.TXT) {
+		return nil
+	}
+	value := ""
+	if len(remaining) > 0 {
+		record.TXT = remaining
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		value = string(payload)
+	}
+	replaced, err := autodns.zoneReplace(zone, field, old, value)
+	if err != nil || !replaced {
+		return err
+	}
+	logger.Info(`Expired ACME digests removed from `, field, ` in `, zone)
+	return nil
+}
+
+func (autodns *Autodns) zoneFields(zone string) ([]string, error) {
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("HKEYS", autodns.keyPrefix+zone+autodns.keySuffix))
+}
+
+func (autodns *Autodns) acmeCleanupInterval() time.Duration {
+	interval := autodns.AcmeExpire / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+func (autodns *Autodns) startAcmeCleanup() error {
+	autodns.acmeCleanupStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(autodns.acmeCleanupInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				autodns.CleanupExpiredAcme()
+			}
+		}
+	}(autodns.acmeCleanupStop)
+	return nil
+}
+
+func (autodns *Autodns) stopAcmeCleanup() error {
+	if autodns.acmeCleanupStop != nil {
+		close(autodns.acmeCleanupStop)
+		autodns.acmeCleanupStop = nil
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package autodns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func seedAcmeDigests(t *testing.T, mr *miniredis.Miniredis, a *Autodns, field string, published ...int64) {
+	t.Helper()
+
+	txts := make([]string, 0, len(published))
+	for i, p := range published {
+		txts = append(txts, fmt.Sprintf(`{"ttl":120,"text":"digest%02dABC-_def456GHI789jkl012","published":%d}`, i, p))
+	}
+	mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, field, `{"txt":[`+strings.Join(txts, ",")+`]}`)
+}
+
+func TestAcmePublishStoresTimestamp(t *testing.T) {
+	a, _ := acmeAutodns(t)
+	before := time.Now().Unix()
+
+	qname := "_acme-reg." + testAcmeDigest + ".host1." + exampleZone
+	if resp := serveDNS(t, a, "100.64.0.10", qname, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("publish rcode = %d", resp.Rcode)
+	}
+	record, err := a.readRecordField(exampleZone, "_acme-challenge.host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.TXT) != 1 || record.TXT[0].Published < before {
+		t.Fatalf("stored TXT = %+v, want publish timestamp >= %d", record.TXT, before)
+	}
+}
+
+func TestAcmeExpiredDigestsNotServed(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	a.AcmeExpire = time.Hour
+	now := time.Now().Unix()
+	seedAcmeDigests(t, mr, a, "_acme-challenge.host1", now-7200, now-60)
+
+	resp := serveDNS(t, a, "8.8.8.8", "_acme-challenge.host1."+exampleZone, dns.TypeTXT)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answer count = %d, want only the fresh digest", len(resp.Answer))
+	}
+	if got := strings.Join(resp.Answer[0].(*dns.TXT).Txt, ""); !strings.HasPrefix(got, "digest01") {
+		t.Fatalf("served %q, want fresh digest", got)
+	}
+
+	t.Run("expiry disabled", func(t *testing.T) {
+		a.AcmeExpire = 0
+		defer func() { a.AcmeExpire = time.Hour }()
+		resp := serveDNS(t, a, "8.8.8.8", "_acme-challenge.host1."+exampleZone, dns.TypeTXT)
+		if len(resp.Answer) != 2 {
+			t.Fatalf("answer count = %d, want 2 without acme.expire", len(resp.Answer))
+		}
+	})
+
+	t.Run("non-ACME name", func(t *testing.T) {
+		mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, "notacme", `{"txt":[{"text":"keep","published":1}]}`)
+		resp := serveDNS(t, a, "8.8.8.8", "notacme."+exampleZone, dns.TypeTXT)
+		if len(resp.Answer) != 1 {
+			t.Fatalf("answer count = %d, want TXT with old published served", len(resp.Answer))
+		}
+	})
+}
+
+func TestAcmePublishDropsExpired(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	a.AcmeExpire = time.Hour
+	seedAcmeDigests(t, mr, a, "_acme-challenge.host1", time.Now().Unix()-7200)
+
+	qname := "_acme-reg." + testAcmeDigest + ".host1." + exampleZone
+	if resp := serveDNS(t, a, "100.64.0.10", qname, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("publish rcode = %d", resp.Rcode)
+	}
+	stored := mr.HGet(a.keyPrefix+exampleZone+a.keySuffix, "_acme-challenge.host1")
+	if strings.Contains(stored, "digest00") || !strings.Contains(stored, testAcmeDigest) {
+		t.Fatalf("redis = %q, want expired digest dropped", stored)
+	}
+}
+
+func TestCleanupExpiredAcme(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	a.AcmeExpire = time.Hour
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	now := time.Now().Unix()
+
+	seedAcmeDigests(t, mr, a, "_acme-challenge", now-7200, now-3700)
+	seedAcmeDigests(t, mr, a, "_acme-challenge.host1", now-7200, now-60)
+	seedAcmeDigests(t, mr, a, "_acme-challenge.host2", now-60)
+	seedAcmeDigests(t, mr, a, "_acme-challenge.legacy", 0)
+	mr.HSet(zoneKey, "notacme", `{"txt":[{"text":"keep","published":1}]}`)
+
+	a.CleanupExpiredAcme()
+
+	if stored := mr.HGet(zoneKey, "_acme-challenge"); stored != "" {
+		t.Fatalf("fully expired apex field should be deleted, got %q", stored)
+	}
+	if stored := mr.HGet(zoneKey, "_acme-challenge.host1"); strings.Contains(stored, "digest00") || !strings.Contains(stored, "digest01") {
+		t.Fatalf("host1 = %q, want only fresh digest", stored)
+	}
+	if stored := mr.HGet(zoneKey, "_acme-challenge.host2"); !strings.Contains(stored, "digest00") {
+		t.Fatalf("host2 = %q, want untouched", stored)
+	}
+	if stored := mr.HGet(zoneKey, "_acme-challenge.legacy"); stored == "" {
+		t.Fatal("digests without publish timestamp must be kept")
+	}
+	if stored := mr.HGet(zoneKey, "notacme"); stored == "" {
+		t.Fatal("non-ACME fields must not be touched")
+	}
+}
+
+func TestCleanupExpiredAcmeConcurrentPublish(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	a.AcmeExpire = time.Hour
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	now := time.Now()
+
+	for _, field := range []string{"_acme-challenge.host1", "_acme-challenge.host2"} {
+		published := []int64{now.Unix() - 7200}
+		if field == "_acme-challenge.host2" {
+			published = append(published, now.Unix()-60)
+		}
+		seedAcmeDigests(t, mr, a, field, published...)
+		old := mr.HGet(zoneKey, field)
+
+		// a registration lands between the cleanup's read and its write
+		if err := a.AddAcmeTXTRecord(exampleZone, field, testAcmeDigest); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.replaceExpiredAcme(exampleZone, field, old, now); err != nil {
+			t.Fatal(err)
+		}
+		if stored := mr.HGet(zoneKey, field); !strings.Contains(stored, testAcmeDigest) {
+			t.Fatalf("%s = %q, want the new digest kept", field, stored)
+		}
+	}
+}
+
+func TestAcmeExpireSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	corefile := fmt.Sprintf(`autodns {
+		address %s
+		acme.expire 3600
+	}`, mr.Addr())
+
+	c := caddy.NewTestController("dns", corefile)
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if a.AcmeExpire != time.Hour {
+		t.Fatalf("AcmeExpire = %v, want 1h", a.AcmeExpire)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.expire soon
+	}`, mr.Addr()))
+	if _, err := redisSetup(c); err == nil {
+		t.Fatal("expected error for invalid acme.expire")
+	}
+}
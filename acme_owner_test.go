@@ -0,0 +1,117 @@
+package autodns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func ownerAutodns(t *testing.T) (*Autodns, *miniredis.Miniredis) {
+	t.Helper()
+	a, mr := acmeAutodns(t)
+	a.AcmeRequireOwner = true
+	a.AcmeAdminNetworks = mustParseCIDRs(t, "100.64.99.0/24", "192.0.2.0/24")
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	mr.HSet(zoneKey, "host1", `{"a":[{"ttl":300,"ip":"100.64.0.10"}]}`)
+	mr.HSet(zoneKey, "host2", `{"aaaa":[{"ttl":300,"ip":"fd00::2"}]}`)
+	return a, mr
+}
+
+func TestAcmeRequireOwner(t *testing.T) {
+	a, mr := ownerAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	tests := []struct {
+		name  string
+		ip    string
+		qname string
+		field string
+		want  int
+	}{
+		{name: "owner publishes", ip: "100.64.0.10", qname: "_acme-reg." + testAcmeDigest + ".host1." + exampleZone, field: "_acme-challenge.host1", want: dns.RcodeSuccess},
+		{name: "other host denied", ip: "100.64.0.11", qname: "_acme-reg." + testAcmeDigest + ".host1." + exampleZone, field: "", want: dns.RcodeNameError},
+		{name: "unregistered host denied", ip: "100.64.0.10", qname: "_acme-reg." + testAcmeDigest + ".host3." + exampleZone, field: "_acme-challenge.host3", want: dns.RcodeNameError},
+		{name: "apex denied to owner", ip: "100.64.0.10", qname: "_acme-reg." + testAcmeDigest + "." + exampleZone, field: "_acme-challenge", want: dns.RcodeNameError},
+		{name: "apex from admin network", ip: "100.64.99.1", qname: "_acme-reg." + testAcmeDigest + "." + exampleZone, field: "_acme-challenge", want: dns.RcodeSuccess},
+		{name: "admin network for any host", ip: "100.64.99.1", qname: "_acme-reg." + testAcmeDigest + ".host3." + exampleZone, field: "_acme-challenge.host3", want: dns.RcodeSuccess},
+		{name: "admin network outside acme network", ip: "192.0.2.1", qname: "_acme-reg." + testAcmeDigest + ".host2." + exampleZone, field: "_acme-challenge.host2", want: dns.RcodeSuccess},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := serveDNS(t, a, tc.ip, tc.qname, dns.TypeTXT)
+			if resp.Rcode != tc.want {
+				t.Fatalf("rcode = %d, want %d", resp.Rcode, tc.want)
+			}
+			if tc.field == "" {
+				return
+			}
+			stored := mr.HGet(zoneKey, tc.field)
+			if published := strings.Contains(stored, testAcmeDigest); published != (tc.want == dns.RcodeSuccess) {
+				t.Fatalf("redis %s = %q", tc.field, stored)
+			}
+		})
+	}
+}
+
+func TestAcmeRequireOwnerDelete(t *testing.T) {
+	a, mr := ownerAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	if resp := serveDNS(t, a, "100.64.0.10", "_acme-reg."+testAcmeDigest+".host1."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("publish rcode = %d", resp.Rcode)
+	}
+	if resp := serveDNS(t, a, "100.64.0.11", "_acme-del.host1."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("foreign delete rcode = %d, want NXDOMAIN", resp.Rcode)
+	}
+	if stored := mr.HGet(zoneKey, "_acme-challenge.host1"); stored == "" {
+		t.Fatal("foreign delete removed the challenge")
+	}
+	if resp := serveDNS(t, a, "100.64.0.10", "_acme-del.host1."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("owner delete rcode = %d", resp.Rcode)
+	}
+	if stored := mr.HGet(zoneKey, "_acme-challenge.host1"); stored != "" {
+		t.Fatalf("redis = %q, want challenge deleted", stored)
+	}
+}
+
+func TestAcmeOwnerAllowedIPv6(t *testing.T) {
+	a, _ := ownerAutodns(t)
+	if !a.acmeOwnerAllowed(exampleZone, "host2", "fd00::2") {
+		t.Fatal("AAAA owner must be allowed")
+	}
+	if a.acmeOwnerAllowed(exampleZone, "host2", "fd00::3") {
+		t.Fatal("other IPv6 address must be denied")
+	}
+	a.AcmeRequireOwner = false
+	if !a.acmeOwnerAllowed(exampleZone, "", "192.0.2.1") {
+		t.Fatal("everything is allowed without acme.require_owner")
+	}
+}
+
+func TestAcmeRequireOwnerSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.require_owner
+		acme.admin_network 10.0.0.0/8 fd00::/8
+	}`, mr.Addr()))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if !a.AcmeRequireOwner || len(a.AcmeAdminNetworks) != 2 {
+		t.Fatalf("require owner = %v, admin networks = %v", a.AcmeRequireOwner, a.AcmeAdminNetworks)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.admin_network bogus
+	}`, mr.Addr()))
+	if _, err := redisSetup(c); err == nil {
+		t.Fatal("expected error for invalid admin network")
+	}
+}
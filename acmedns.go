@@ -0,0 +1,273 @@
+package autodns
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	acmednsAccountKey = "_autodns:acmedns"
+	acmednsTXTLength  = 43
+)
+
+// acmednsAccount is stored as JSON in the acme-dns hash, one field per username.
+type acmednsAccount struct {
+	Password  string   `json:"password"`
+	Subdomain string   `json:"subdomain"`
+	AllowFrom []string `json:"allowfrom,omitempty"`
+}
+
+func (account *acmednsAccount) allowsIP(ip net.IP) bool {
+	if len(account.AllowFrom) == 0 {
+		return true
+	}
+	for _, cidr := range account.AllowFrom {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type acmednsRegisterRequest struct {
+	AllowFrom []string `json:"allowfrom"`
+}
+
+type acmednsRegisterResponse struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Fulldomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+type acmednsUpdateRequest struct {
+	Subdomain string `json:"subdomain"`
+	TXT       string `json:"txt"`
+}
+
+func (autodns *Autodns) acmednsKey() string {
+	return autodns.keyPrefix + acmednsAccountKey + autodns.keySuffix
+}
+
+func (autodns *Autodns) acmednsAccount(username string) (*acmednsAccount, error) {
+	conn := autodns.Pool.Get()
+	if conn == nil {
+		return nil, errors.New("error connecting to redis")
+	}
+	defer conn.Close()
+
+	val, err := redis.String(conn.Do("HGET", autodns.acmednsKey(), username))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	account := new(acmednsAccount)
+	if err := json.Unmarshal([]byte(val), account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (autodns *Autodns) saveAcmednsAccount(username string, account *acmednsAccount) error {
+	payload, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	conn := autodns.Pool.Get()
+	if conn == nil {
+		return errors.New("error connecting to redis")
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", autodns.acmednsKey(), username, payload)
+	return err
+}
+
+func (autodns *Autodns) startAcmedns() error {
+	srv, err := listenHTTP("acme-dns", autodns.AcmednsListen, autodns.acmednsHandler())
+	autodns.acmednsServer = srv
+	return err
+}
+
+func (autodns *Autodns) stopAcmedns() error {
+	return shutdownHTTP(autodns.acmednsServer)
+}
+
+func (autodns *Autodns) acmednsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", autodns.serveAcmednsRegister)
+	mux.HandleFunc("/update", autodns.serveAcmednsUpdate)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+func writeAcmednsJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAcmednsError(w http.ResponseWriter, status int, code string) {
+	writeAcmednsJSON(w, status, map[string]string{"error": code})
+}
+
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func randomUUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40
+	buf[8] = (buf[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
+
+func (autodns *Autodns) serveAcmednsRegister(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAcmednsError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	ip := remoteIP(req)
+	if !autodns.acmeAllowed(ip) {
+		logger.Warning(`acme-dns register request from `, req.RemoteAddr, ` not in acme networks`)
+		autodns.stats.acmeDenied.Add(1)
+		writeAcmednsError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+
+	var body acmednsRegisterRequest
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeAcmednsError(w, http.StatusBadRequest, "malformed_json_payload")
+			return
+		}
+	}
+	for _, cidr := range body.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			writeAcmednsError(w, http.StatusBadRequest, "invalid_allowfrom_cidr")
+			return
+		}
+	}
+
+	username, password, account, err := newAcmednsAccount(body.AllowFrom)
+	if err == nil {
+		err = autodns.saveAcmednsAccount(username, account)
+	}
+	if err != nil {
+		logger.Error(`acme-dns register error: `, err)
+		writeAcmednsError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	logger.Info(`acme-dns account `, username, ` registered from `, req.RemoteAddr)
+	writeAcmednsJSON(w, http.StatusCreated, acmednsRegisterResponse{
+		Username:   username,
+		Password:   password,
+		Fulldomain: strings.TrimSuffix(acmePublicName(autodns.AcmednsZone, account.Subdomain), "."),
+		Subdomain:  account.Subdomain,
+		AllowFrom:  append([]string{}, body.AllowFrom...),
+	})
+}
+
+func newAcmednsAccount(allowFrom []string) (username, password string, account *acmednsAccount, err error) {
+	if username, err = randomUUID(); err != nil {
+		return
+	}
+	subdomain, err := randomUUID()
+	if err != nil {
+		return
+	}
+	if password, err = randomHex(20); err != nil {
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+	account = &acmednsAccount{Password: string(hash), Subdomain: subdomain, AllowFrom: allowFrom}
+	return
+}
+
+func (autodns *Autodns) serveAcmednsUpdate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeAcmednsError(w, http.StatusMethodNotAllowed, "method_not_allowed")
+		return
+	}
+	username := req.Header.Get("X-Api-User")
+	password := req.Header.Get("X-Api-Key")
+	if username == "" || password == "" {
+		writeAcmednsError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	account, err := autodns.acmednsAccount(username)
+	if err != nil {
+		logger.Error(`acme-dns error loading account `, username, ` error: `, err)
+		writeAcmednsError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	if account == nil || bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(password)) != nil {
+		logger.Warning(`acme-dns authentication failed for `, username, ` from `, req.RemoteAddr)
+		autodns.stats.acmeDenied.Add(1)
+		writeAcmednsError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+	if !account.allowsIP(remoteIP(req)) {
+		logger.Warning(`acme-dns update for `, username, ` from `, req.RemoteAddr, ` not in allowfrom`)
+		autodns.stats.acmeDenied.Add(1)
+		writeAcmednsError(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+
+	var body acmednsUpdateRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeAcmednsError(w, http.StatusBadRequest, "malformed_json_payload")
+		return
+	}
+	if body.Subdomain != account.Subdomain {
+		writeAcmednsError(w, http.StatusUnauthorized, "bad_subdomain")
+		return
+	}
+	if len(body.TXT) != acmednsTXTLength || !validAcmeDigest(body.TXT) {
+		writeAcmednsError(w, http.StatusBadRequest, "bad_txt")
+		return
+	}
+
+	if err := autodns.publishAcmeDigest(autodns.AcmednsZone, account.Subdomain, body.TXT, req.RemoteAddr); err != nil {
+		if errors.Is(err, errAcmeDenied) {
+			writeAcmednsError(w, http.StatusUnauthorized, "forbidden")
+			return
+		}
+		writeAcmednsError(w, http.StatusInternalServerError, "internal_error")
+		return
+	}
+	writeAcmednsJSON(w, http.StatusOK, map[string]string{"txt": body.TXT})
+}
@@ -0,0 +1,170 @@
+package autodns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+const testAcmednsTXT = "LPsIwTo7o8BoG0-vjCyGQGBWSVIPxI-i_X336eUOQZo"
+
+func acmednsAutodns(t *testing.T) (*Autodns, *miniredis.Miniredis) {
+	t.Helper()
+	a, mr := acmeAutodns(t)
+	a.AcmednsZone = exampleZone
+	return a, mr
+}
+
+func acmednsRequest(t *testing.T, a *Autodns, remote, path string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+	req.RemoteAddr = remote + ":40000"
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	a.acmednsHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+func acmednsRegister(t *testing.T, a *Autodns, body string) acmednsRegisterResponse {
+	t.Helper()
+
+	rec := acmednsRequest(t, a, "100.64.0.10", "/register", nil, body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("register status = %d body %q", rec.Code, rec.Body.String())
+	}
+	var resp acmednsRegisterResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestAcmednsRegisterAndUpdate(t *testing.T) {
+	a, mr := acmednsAutodns(t)
+	account := acmednsRegister(t, a, "")
+
+	if account.Username == "" || account.Password == "" || account.Subdomain == "" {
+		t.Fatalf("incomplete account %+v", account)
+	}
+	wantFull := "_acme-challenge." + account.Subdomain + ".example.net"
+	if account.Fulldomain != wantFull {
+		t.Fatalf("fulldomain = %q, want %q", account.Fulldomain, wantFull)
+	}
+	if stored := mr.HGet(a.acmednsKey(), account.Username); strings.Contains(stored, account.Password) {
+		t.Fatal("password must be stored hashed")
+	}
+
+	headers := map[string]string{"X-Api-User": account.Username, "X-Api-Key": account.Password}
+	body := fmt.Sprintf(`{"subdomain":%q,"txt":%q}`, account.Subdomain, testAcmednsTXT)
+	rec := acmednsRequest(t, a, "192.0.2.1", "/update", headers, body)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), testAcmednsTXT) {
+		t.Fatalf("update = %d %q", rec.Code, rec.Body.String())
+	}
+
+	public := serveDNS(t, a, "8.8.8.8", account.Fulldomain+".", dns.TypeTXT)
+	if len(public.Answer) != 1 || strings.Join(public.Answer[0].(*dns.TXT).Txt, "") != testAcmednsTXT {
+		t.Fatalf("public answer = %v", public.Answer)
+	}
+}
+
+func TestAcmednsRegisterOutsideAcmeNetwork(t *testing.T) {
+	a, _ := acmednsAutodns(t)
+	rec := acmednsRequest(t, a, "8.8.8.8", "/register", nil, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rec.Code)
+	}
+}
+
+func TestAcmednsRegisterFromAdminNetwork(t *testing.T) {
+	a, _ := acmednsAutodns(t)
+	a.AcmeAdminNetworks = mustParseCIDRs(t, "192.0.2.0/24")
+	if rec := acmednsRequest(t, a, "192.0.2.1", "/register", nil, ""); rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201 from acme.admin_network", rec.Code)
+	}
+}
+
+func TestAcmednsUpdateRejected(t *testing.T) {
+	a, mr := acmednsAutodns(t)
+	account := acmednsRegister(t, a, `{"allowfrom":["192.0.2.0/24"]}`)
+	good := map[string]string{"X-Api-User": account.Username, "X-Api-Key": account.Password}
+	goodBody := fmt.Sprintf(`{"subdomain":%q,"txt":%q}`, account.Subdomain, testAcmednsTXT)
+
+	tests := []struct {
+		name     string
+		remote   string
+		headers  map[string]string
+		body     string
+		wantCode int
+		wantErr  string
+	}{
+		{name: "wrong key", remote: "192.0.2.1", headers: map[string]string{"X-Api-User": account.Username, "X-Api-Key": "nope"}, body: goodBody, wantCode: http.StatusUnauthorized, wantErr: "forbidden"},
+		{name: "missing headers", remote: "192.0.2.1", body: goodBody, wantCode: http.StatusUnauthorized, wantErr: "forbidden"},
+		{name: "outside allowfrom", remote: "198.51.100.1", headers: good, body: goodBody, wantCode: http.StatusUnauthorized, wantErr: "forbidden"},
+		{name: "other subdomain", remote: "192.0.2.1", headers: good, body: fmt.Sprintf(`{"subdomain":"host1","txt":%q}`, testAcmednsTXT), wantCode: http.StatusUnauthorized, wantErr: "bad_subdomain"},
+		{name: "short txt", remote: "192.0.2.1", headers: good, body: fmt.Sprintf(`{"subdomain":%q,"txt":"short"}`, account.Subdomain), wantCode: http.StatusBadRequest, wantErr: "bad_txt"},
+		{name: "bad json", remote: "192.0.2.1", headers: good, body: `{`, wantCode: http.StatusBadRequest, wantErr: "malformed_json_payload"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := acmednsRequest(t, a, tc.remote, "/update", tc.headers, tc.body)
+			if rec.Code != tc.wantCode || !strings.Contains(rec.Body.String(), tc.wantErr) {
+				t.Fatalf("got %d %q, want %d %s", rec.Code, rec.Body.String(), tc.wantCode, tc.wantErr)
+			}
+		})
+	}
+	if stored := mr.HGet(a.keyPrefix+exampleZone+a.keySuffix, acmeRedisField(account.Subdomain)); stored != "" {
+		t.Fatalf("rejected updates wrote redis: %q", stored)
+	}
+}
+
+func TestAcmednsUpdateAcmeDeny(t *testing.T) {
+	a, mr := acmednsAutodns(t)
+	account := acmednsRegister(t, a, "")
+	a.AcmeDeny = []string{account.Subdomain}
+
+	headers := map[string]string{"X-Api-User": account.Username, "X-Api-Key": account.Password}
+	body := fmt.Sprintf(`{"subdomain":%q,"txt":%q}`, account.Subdomain, testAcmednsTXT)
+	rec := acmednsRequest(t, a, "192.0.2.1", "/update", headers, body)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401 for acme.deny", rec.Code)
+	}
+	if stored := mr.HGet(a.keyPrefix+exampleZone+a.keySuffix, acmeRedisField(account.Subdomain)); stored != "" {
+		t.Fatalf("denied update wrote redis: %q", stored)
+	}
+}
+
+func TestAcmednsSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acmedns.listen 127.0.0.1:8443
+		acmedns.zone Auth.Example.Net
+	}`, mr.Addr()))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if a.AcmednsListen != "127.0.0.1:8443" || a.AcmednsZone != "auth.example.net." {
+		t.Fatalf("listen/zone = %q / %q", a.AcmednsListen, a.AcmednsZone)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acmedns.listen 127.0.0.1:8443
+	}`, mr.Addr()))
+	if _, err := redisSetup(c); err == nil {
+		t.Fatal("expected error without acmedns.zone")
+	}
+}
@@ -0,0 +1,228 @@
+// Package acmeprovider is a lego-style DNS-01 challenge provider that publishes
+// digests on autodns nameservers with _acme-reg. / _acme-del. TXT queries.
+//
+//	provider, err := acmeprovider.NewDNSProviderConfig(&acmeprovider.Config{
+//		Nameservers: []string{"ns1.example.com:53", "ns2.example.com:53"},
+//	})
+//	client.Challenge.SetDNS01Provider(provider)
+package acmeprovider
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Environment variables read by NewDNSProvider.
+const (
+	EnvNameservers        = "AUTODNS_NAMESERVERS"
+	EnvPropagationTimeout = "AUTODNS_PROPAGATION_TIMEOUT"
+	EnvPollingInterval    = "AUTODNS_POLLING_INTERVAL"
+	EnvDNSTimeout         = "AUTODNS_DNS_TIMEOUT"
+)
+
+// Config holds the provider settings.
+type Config struct {
+	// Nameservers are the autodns servers to publish on, host or host:port.
+	Nameservers        []string
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+	// DNSTimeout is the per-query timeout.
+	DNSTimeout time.Duration
+	// TCP forces TCP instead of UDP with TCP fallback on truncation.
+	TCP bool
+}
+
+// NewDefaultConfig returns a Config with default timeouts and no nameservers.
+func NewDefaultConfig() *Config {
+	return &Config{
+		PropagationTimeout: 2 * time.Minute,
+		PollingInterval:    2 * time.Second,
+		DNSTimeout:         5 * time.Second,
+	}
+}
+
+// DNSProvider implements the lego challenge.Provider and
+// challenge.ProviderTimeout interfaces.
+type DNSProvider struct {
+	config *Config
+}
+
+// NewDNSProvider returns a provider configured from AUTODNS_* environment variables.
+func NewDNSProvider() (*DNSProvider, error) {
+	config := NewDefaultConfig()
+	for _, ns := range strings.Split(os.Getenv(EnvNameservers), ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			config.Nameservers = append(config.Nameservers, ns)
+		}
+	}
+	for env, target := range map[string]*time.Duration{
+		EnvPropagationTimeout: &config.PropagationTimeout,
+		EnvPollingInterval:    &config.PollingInterval,
+		EnvDNSTimeout:         &config.DNSTimeout,
+	} {
+		if val := os.Getenv(env); val != "" {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("autodns: %s: %w", env, err)
+			}
+			*target = d
+		}
+	}
+	return NewDNSProviderConfig(config)
+}
+
+// NewDNSProviderConfig returns a provider for config.
+func NewDNSProviderConfig(config *Config) (*DNSProvider, error) {
+	if config == nil {
+		return nil, errors.New("autodns: the configuration of the DNS provider is nil")
+	}
+	if len(config.Nameservers) == 0 {
+		return nil, errors.New("autodns: no nameservers configured")
+	}
+	c := *config
+	c.Nameservers = make([]string, 0, len(config.Nameservers))
+	for _, ns := range config.Nameservers {
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		c.Nameservers = append(c.Nameservers, ns)
+	}
+	return &DNSProvider{config: &c}, nil
+}
+
+// Timeout returns the propagation timeout and polling interval.
+func (d *DNSProvider) Timeout() (timeout, interval time.Duration) {
+	return d.config.PropagationTimeout, d.config.PollingInterval
+}
+
+// ChallengeDigest returns the TXT value for keyAuth, computed like lego's
+// dns01.GetRecord: unpadded base64url of the SHA-256 of the key authorization.
+func ChallengeDigest(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Present publishes the digest on every nameserver and waits until all of them
+// serve it under _acme-challenge.
+func (d *DNSProvider) Present(domain, token, keyAuth string) error {
+	name := challengeDomain(domain)
+	digest := ChallengeDigest(keyAuth)
+	if err := d.each(func(server string) error {
+		return d.command(server, "_acme-reg."+digest+"."+name)
+	}); err != nil {
+		return fmt.Errorf("autodns: publish %s: %w", name, err)
+	}
+	return d.waitPropagation(name, digest)
+}
+
+// CleanUp removes the digest from every nameserver.
+func (d *DNSProvider) CleanUp(domain, token, keyAuth string) error {
+	name := challengeDomain(domain)
+	digest := ChallengeDigest(keyAuth)
+	if err := d.each(func(server string) error {
+		return d.command(server, "_acme-del."+digest+"."+name)
+	}); err != nil {
+		return fmt.Errorf("autodns: clean up %s: %w", name, err)
+	}
+	return nil
+}
+
+func challengeDomain(domain string) string {
+	return dns.Fqdn(strings.ToLower(strings.TrimPrefix(domain, "*.")))
+}
+
+// each runs fn for every nameserver in parallel and joins the errors.
+func (d *DNSProvider) each(fn func(server string) error) error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	for _, server := range d.config.Nameservers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			if err := fn(server); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", server, err))
+				mu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (d *DNSProvider) exchange(server, name string) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	m.RecursionDesired = false
+
+	c := &dns.Client{Timeout: d.config.DNSTimeout}
+	if d.config.TCP {
+		c.Net = "tcp"
+	}
+	resp, _, err := c.Exchange(m, server)
+	if err == nil && resp.Truncated && c.Net != "tcp" {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(m, server)
+	}
+	return resp, err
+}
+
+// command sends one _acme-reg. / _acme-del. query and checks the answer.
+func (d *DNSProvider) command(server, name string) error {
+	resp, err := d.exchange(server, name)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("%s answered %s", name, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+func (d *DNSProvider) serves(server, name, digest string) bool {
+	resp, err := d.exchange(server, "_acme-challenge."+name)
+	if err != nil {
+		return false
+	}
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// waitPropagation polls every nameserver until all serve digest or the
+// propagation timeout passes.
+func (d *DNSProvider) waitPropagation(name, digest string) error {
+	deadline := time.Now().Add(d.config.PropagationTimeout)
+	pending := d.config.Nameservers
+	for {
+		var lagging []string
+		for _, server := range pending {
+			if !d.serves(server, name, digest) {
+				lagging = append(lagging, server)
+			}
+		}
+		if len(lagging) == 0 {
+			return nil
+		}
+		if time.Now().Add(d.config.PollingInterval).After(deadline) {
+			return fmt.Errorf("autodns: %s not served by %s after %s", "_acme-challenge."+name, strings.Join(lagging, ", "), d.config.PropagationTimeout)
+		}
+		pending = lagging
+		time.Sleep(d.config.PollingInterval)
+	}
+}
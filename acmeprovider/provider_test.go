@@ -0,0 +1,167 @@
+package acmeprovider
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeAutodns keeps ACME digests like autodns does; hidden delays serving
+// newly published digests to simulate a lagging secondary.
+type fakeAutodns struct {
+	mu      sync.Mutex
+	digests map[string][]string
+	hidden  int
+	deny    bool
+}
+
+func (f *fakeAutodns) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	txt := func(values ...string) {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: values,
+		})
+	}
+	switch {
+	case f.deny && (strings.HasPrefix(q.Name, "_acme-reg.") || strings.HasPrefix(q.Name, "_acme-del.")):
+		m.Rcode = dns.RcodeNameError
+	case strings.HasPrefix(q.Name, "_acme-reg."):
+		parts := strings.SplitN(q.Name, ".", 3)
+		f.digests[parts[2]] = append(f.digests[parts[2]], parts[1])
+		txt("_acme-challenge." + strings.TrimSuffix(parts[2], "."))
+	case strings.HasPrefix(q.Name, "_acme-del."):
+		parts := strings.SplitN(q.Name, ".", 3)
+		kept := f.digests[parts[2]][:0]
+		for _, d := range f.digests[parts[2]] {
+			if d != parts[1] {
+				kept = append(kept, d)
+			}
+		}
+		f.digests[parts[2]] = kept
+		txt("deleted")
+	case strings.HasPrefix(q.Name, "_acme-challenge."):
+		if f.hidden > 0 {
+			f.hidden--
+			break
+		}
+		for _, d := range f.digests[strings.TrimPrefix(q.Name, "_acme-challenge.")] {
+			txt(d)
+		}
+	}
+	_ = w.WriteMsg(m)
+}
+
+// published returns the digests currently kept for zone.
+func (f *fakeAutodns) published(zone string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.digests[zone]...)
+}
+
+func startFake(t *testing.T, f *fakeAutodns) string {
+	t.Helper()
+	f.digests = map[string][]string{}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: f}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func testProvider(t *testing.T, servers ...string) *DNSProvider {
+	t.Helper()
+	config := NewDefaultConfig()
+	config.Nameservers = servers
+	config.PropagationTimeout = time.Second
+	config.PollingInterval = 10 * time.Millisecond
+	config.DNSTimeout = time.Second
+	p, err := NewDNSProviderConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestChallengeDigest(t *testing.T) {
+	if got := ChallengeDigest("abc"); got != "ungWv48Bz-pBQUDeXa4iI7ADYaOWF3qctBD_YfIAFa0" {
+		t.Fatalf("ChallengeDigest = %q", got)
+	}
+}
+
+func TestPresentAndCleanUp(t *testing.T) {
+	ns1 := &fakeAutodns{}
+	ns2 := &fakeAutodns{hidden: 3}
+	p := testProvider(t, startFake(t, ns1), startFake(t, ns2))
+	digest := ChallengeDigest("token.key")
+
+	if err := p.Present("*.example.com", "token", "token.key"); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	for _, ns := range []*fakeAutodns{ns1, ns2} {
+		if got := ns.published("example.com."); len(got) != 1 || got[0] != digest {
+			t.Fatalf("digests = %v, want [%s]", got, digest)
+		}
+	}
+
+	if err := p.CleanUp("*.example.com", "token", "token.key"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	for _, ns := range []*fakeAutodns{ns1, ns2} {
+		if got := ns.published("example.com."); len(got) != 0 {
+			t.Fatalf("digests after CleanUp = %v", got)
+		}
+	}
+}
+
+func TestPresentErrors(t *testing.T) {
+	t.Run("denied", func(t *testing.T) {
+		p := testProvider(t, startFake(t, &fakeAutodns{}), startFake(t, &fakeAutodns{deny: true}))
+		if err := p.Present("host1.example.com", "token", "token.key"); err == nil || !strings.Contains(err.Error(), "NXDOMAIN") {
+			t.Fatalf("err = %v, want NXDOMAIN", err)
+		}
+	})
+	t.Run("never propagates", func(t *testing.T) {
+		p := testProvider(t, startFake(t, &fakeAutodns{hidden: 1 << 30}))
+		if err := p.Present("host1.example.com", "token", "token.key"); err == nil || !strings.Contains(err.Error(), "not served") {
+			t.Fatalf("err = %v, want propagation timeout", err)
+		}
+	})
+}
+
+func TestNewDNSProvider(t *testing.T) {
+	t.Setenv(EnvNameservers, "ns1.example.com, 192.0.2.1:5353")
+	t.Setenv(EnvPropagationTimeout, "30s")
+	p, err := NewDNSProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(p.config.Nameservers, ","); got != "ns1.example.com:53,192.0.2.1:5353" {
+		t.Fatalf("nameservers = %q", got)
+	}
+	if timeout, interval := p.Timeout(); timeout != 30*time.Second || interval != 2*time.Second {
+		t.Fatalf("Timeout = %s, %s", timeout, interval)
+	}
+
+	t.Setenv(EnvNameservers, "")
+	if _, err := NewDNSProvider(); err == nil {
+		t.Fatal("expected error without nameservers")
+	}
+	t.Setenv(EnvNameservers, "ns1.example.com")
+	t.Setenv(EnvPollingInterval, "soon")
+	if _, err := NewDNSProvider(); err == nil {
+		t.Fatal("expected error for invalid duration")
+	}
+}
@@ -5,12 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/transfer"
 
 	redisCon "github.com/gomodule/redigo/redis"
 )
@@ -25,16 +29,53 @@ type Autodns struct {
 	keyPrefix        string
 	keySuffix        string
 	Ttl              uint32
-	Zones            []string
+	Origins          []string
+	ZonesAllow       []string
+	ZonesDeny        []string
+	zoneSnapshot     atomic.Pointer[zoneSnapshot]
+	ZoneRefresh      time.Duration
+	zoneRefreshStop  chan struct{}
+	zoneRefreshNow   chan struct{}
 	Verbose          bool
 	AutoCreate       []string
-	LastZoneUpdate   time.Time
 	RegisterNetworks []net.IPNet
 	RegisterDeny     []string
 	AcmeNetworks     []net.IPNet
 	AcmeDeny         []string
 	AcmeRrTtl        uint32
 	AcmeRotate       int
+	AcmeExpire       time.Duration
+	acmeCleanupStop  chan struct{}
+	AcmeCertificates [][]string
+	AcmeDirectory    string
+	AcmeEmail        string
+	certHTTPClient   *http.Client
+	certStop         chan struct{}
+	AcmeDelegations  []acmeDelegation
+	AcmeRequireOwner bool
+	acmeCheckPort    string
+	AcmeCaa          []caaIssuer
+	AcmeCaaIodef     string
+	AcmePersist      []persistIssuer
+	AuthorityNS      bool
+	AnyResponse      string
+	AnyFullNetworks  []net.IPNet
+	StatusNetworks   []net.IPNet
+	ChaosNetworks    []net.IPNet
+	DyndnsListen     string
+	dyndnsServer     *http.Server
+	AcmednsListen    string
+	AcmednsZone      string
+	acmednsServer    *http.Server
+	zoneCache        *zoneCache
+	JournalLength    int
+	NotifyTargets    []string
+	serialWatch      serialWatch
+	transfer         atomic.Pointer[transfer.Transfer]
+	stats            autodnsStats
+
+	// AcmeAdminNetworks may publish any ACME challenge, see acmeOwnerAllowed.
+	AcmeAdminNetworks []net.IPNet
 }
 
 func (autodns *Autodns) acmeNetworks() []net.IPNet {
@@ -44,6 +85,13 @@ func (autodns *Autodns) acmeNetworks() []net.IPNet {
 	return autodns.RegisterNetworks
 }
 
+// acmeAllowed reports whether ip may publish ACME challenges: acme.network, or
+// acme.admin_network, whose clients need not also be listed in acme.network.
+func (autodns *Autodns) acmeAllowed(ip net.IP) bool {
+	return IPBelongsToRegisterNetworks(ip, autodns.acmeNetworks()) ||
+		IPBelongsToRegisterNetworks(ip, autodns.AcmeAdminNetworks)
+}
+
 func (autodns *Autodns) acmeRotate() int {
 	if autodns.AcmeRotate <= 0 {
 		return defaultAcmeRotate
@@ -100,23 +148,24 @@ func (autodns *Autodns) CreateZone(zone string) error {
 	r2.SOA.MinTtl = autodns.Ttl
 	if soa, _ := json.Marshal(r2); len(soa) > 0 {
 		//HSET _dns:test.com. @ '{"soa": {"mname": "ns1.test.com.", "rname": "hostmaster.test.com.", "serial": 2024012901, "refresh": 7200, "retry": 3600, "expire": 1209600, "minimum": 3600}}'
-		_, err := conn.Do("HSET", autodns.keyPrefix+zone+autodns.keySuffix, "@", soa)
+		err := autodns.zoneWrite(zone, "@", string(soa))
 		if err != nil {
 			fmt.Println("error creating zone: ", err)
 			return err
 		}
+		if err := autodns.registerZone(conn, zone); err != nil {
+			fmt.Println("error registering zone: ", err)
+			return err
+		}
 		fmt.Printf("zone %s SOA created\n", zone)
 	}
 	return nil
 }
 
+// LoadZones reads the zone registry, creating the autocreate zones and
+// migrating zone hashes found by SCAN when needed, and publishes the result
+// as a new snapshot. On error the previous snapshot stays in place.
 func (autodns *Autodns) LoadZones() {
-	var (
-		reply interface{}
-		err   error
-		zones []string
-	)
-
 	conn := autodns.Pool.Get()
 	if conn == nil {
 		fmt.Println("error connecting to redis")
@@ -124,18 +173,34 @@ func (autodns *Autodns) LoadZones() {
 	}
 	defer conn.Close()
 
-	reply, err = conn.Do("KEYS", autodns.keyPrefix+"*"+autodns.keySuffix)
+	zones, ok, err := autodns.registeredZones(conn)
 	if err != nil {
+		logger.Error("error reading zone registry: ", err)
 		return
 	}
-	zones, _ = redisCon.Strings(reply, nil)
-	for i := range zones {
-		zones[i] = strings.TrimPrefix(zones[i], autodns.keyPrefix)
-		zones[i] = strings.TrimSuffix(zones[i], autodns.keySuffix)
+	if !ok {
+		zones, err = autodns.scanZones(conn)
+		if err != nil {
+			logger.Error("error scanning for zones: ", err)
+			return
+		}
+		for _, zone := range zones {
+			if err := autodns.registerZone(conn, zone); err != nil {
+				logger.Error("error registering zone ", zone, ": ", err)
+				return
+			}
+		}
+		if len(zones) > 0 {
+			logger.Info("Registered existing zones: ", zones)
+		}
 	}
 	// go over autocreate and create zones if they don't exist
 	for _, zone := range autodns.AutoCreate {
 		zone = UniformZone(zone)
+		if !autodns.zoneAllowed(zone) {
+			logger.Warning("autocreate zone ", zone, " is outside the served zones, not creating it")
+			continue
+		}
 		if !contains(zones, zone) {
 			if err := autodns.CreateZone(zone); err != nil {
 				logger.Info("error creating zone: ", err)
@@ -144,9 +209,14 @@ func (autodns *Autodns) LoadZones() {
 			}
 		}
 	}
-	logger.Info("Loaded zones from Redis: ", zones)
-	autodns.LastZoneUpdate = time.Now()
-	autodns.Zones = zones
+	zones, ignored := autodns.servedZones(zones)
+	if previous := autodns.zoneSnapshot.Load(); len(ignored) > 0 && (previous == nil || !slices.Equal(ignored, previous.ignored)) {
+		logger.Warning("Ignoring zones outside the server block or zones allow/deny: ", ignored)
+	}
+	if autodns.Verbose || !slices.Equal(zones, autodns.zones()) {
+		logger.Info("Loaded zones from Redis: ", zones)
+	}
+	autodns.zoneSnapshot.Store(&zoneSnapshot{zones: zones, ignored: ignored, updated: time.Now()})
 }
 
 func (autodns *Autodns) A(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
@@ -261,21 +331,23 @@ func (autodns *Autodns) SOA(name string, z *Zone, record *Record) (answers, extr
 		r.Expire = record.SOA.Expire
 		r.Minttl = record.SOA.MinTtl
 	}
-	r.Serial = autodns.serial()
+	r.Serial = z.Serial
 	answers = append(answers, r)
 	return
 }
 
 func (autodns *Autodns) CAA(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
-	if record == nil {
-		return
+	var stored []CAA_Record
+	if record != nil {
+		stored = record.CAA
 	}
-	for _, caa := range record.CAA {
+	for _, caa := range mergeCAA(stored, autodns.managedCAA(name, z, record)) {
 		if caa.Value == "" || caa.Tag == "" {
 			continue
 		}
 		r := new(dns.CAA)
-		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCAA, Class: dns.ClassINET}
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeCAA,
+			Class: dns.ClassINET, Ttl: autodns.minTtl(caa.Ttl)}
 		r.Flag = caa.Flag
 		r.Tag = caa.Tag
 		r.Value = caa.Value
@@ -284,63 +356,43 @@ func (autodns *Autodns) CAA(name string, z *Zone, record *Record) (answers, extr
 	return
 }
 
-func (autodns *Autodns) AXFR(z *Zone) (records []dns.RR) {
-	//soa, _ := redis.SOA(z.Name, z, record)
-	soa := make([]dns.RR, 0)
-	answers := make([]dns.RR, 0, 10)
-	extras := make([]dns.RR, 0, 10)
-
-	// Allocate slices for rr Records
-	records = append(records, soa...)
-	for key := range z.Locations {
-		if key == "@" {
-			location := autodns.findLocation(z.Name, z)
-			record := autodns.get(location, z)
-			soa, _ = autodns.SOA(z.Name, z, record)
-		} else {
-			fqdnKey := dns.Fqdn(key) + z.Name
-			var as []dns.RR
-			var xs []dns.RR
-
-			location := autodns.findLocation(fqdnKey, z)
-			record := autodns.get(location, z)
-
-			// Pull all zone records
-			as, xs = autodns.A(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
-
-			as, xs = autodns.AAAA(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
-
-			as, xs = autodns.CNAME(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
-
-			as, xs = autodns.MX(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
-
-			as, xs = autodns.SRV(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
-
-			as, xs = autodns.TXT(fqdnKey, z, record)
-			answers = append(answers, as...)
-			extras = append(extras, xs...)
+func (autodns *Autodns) DS(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	for _, ds := range record.DS {
+		if ds.Digest == "" {
+			continue
 		}
+		r := new(dns.DS)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeDS,
+			Class: dns.ClassINET, Ttl: autodns.minTtl(ds.Ttl)}
+		r.KeyTag = ds.KeyTag
+		r.Algorithm = ds.Algorithm
+		r.DigestType = ds.DigestType
+		r.Digest = strings.ToUpper(ds.Digest)
+		answers = append(answers, r)
 	}
-
-	records = soa
-	records = append(records, answers...)
-	records = append(records, extras...)
-	records = append(records, soa...)
-
-	fmt.Println(records)
 	return
 }
 
+func (autodns *Autodns) AXFR(z *Zone) (records []dns.RR, err error) {
+	soa, err := autodns.zoneSOA(z)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, soa)
+	for _, key := range sortedLocations(z) {
+		record, err := autodns.get(key, z)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			continue
+		}
+		records = append(records, autodns.recordRRs(key, z, record)...)
+	}
+	records = append(records, soa)
+	return records, nil
+}
+
 func (autodns *Autodns) hosts(name string, z *Zone) []dns.RR {
 	var (
 		record  *Record
@@ -350,7 +402,10 @@ func (autodns *Autodns) hosts(name string, z *Zone) []dns.RR {
 	if location == "" {
 		return nil
 	}
-	record = autodns.get(location, z)
+	// additional data is best effort; a read error just leaves it out
+	if record, _ = autodns.get(location, z); record == nil {
+		return nil
+	}
 	a, _ := autodns.A(name, z, record)
 	answers = append(answers, a...)
 	aaaa, _ := autodns.AAAA(name, z, record)
@@ -360,10 +415,6 @@ func (autodns *Autodns) hosts(name string, z *Zone) []dns.RR {
 	return answers
 }
 
-func (autodns *Autodns) serial() uint32 {
-	return uint32(time.Now().Unix())
-}
-
 func (autodns *Autodns) minTtl(ttl uint32) uint32 {
 	if autodns.Ttl == 0 && ttl == 0 {
 		return defaultTtl
@@ -380,53 +431,31 @@ func (autodns *Autodns) minTtl(ttl uint32) uint32 {
 	return ttl
 }
 
+// findLocation returns the hash field answering query: the name itself, or
+// the wildcard synthesizing it (RFC 4592). Empty non-terminals and names
+// without a matching wildcard return "".
 func (autodns *Autodns) findLocation(query string, z *Zone) string {
-	var (
-		ok                                 bool
-		closestEncloser, sourceOfSynthesis string
-	)
-
-	// request for zone records
 	if query == z.Name {
 		return query
 	}
-
-	query = strings.TrimSuffix(query, "."+z.Name)
-
-	if _, ok = z.Locations[query]; ok {
-		return query
+	labels, ok := relativeLabels(query, z)
+	if !ok {
+		return ""
 	}
-
-	closestEncloser, sourceOfSynthesis, ok = splitQuery(query)
-	for ok {
-		ceExists := keyMatches(closestEncloser, z) || keyExists(closestEncloser, z)
-		ssExists := keyExists(sourceOfSynthesis, z)
-		if ceExists {
-			if ssExists {
-				return sourceOfSynthesis
-			} else {
-				return ""
-			}
-		} else {
-			closestEncloser, sourceOfSynthesis, ok = splitQuery(closestEncloser)
-		}
+	exact, wildcard := z.labels().lookup(labels)
+	switch {
+	case exact != nil && exact.data:
+		return exact.key
+	case wildcard != nil && wildcard.data:
+		return wildcard.key
 	}
 	return ""
 }
 
-func (autodns *Autodns) get(key string, z *Zone) *Record {
-	var (
-		err   error
-		reply interface{}
-		val   string
-	)
-	conn := autodns.Pool.Get()
-	if conn == nil {
-		fmt.Println("error connecting to redis")
-		return nil
-	}
-	defer conn.Close()
-
+// get returns the record stored at key, or nil when there is none. Failing to
+// read or decode it is an error, which callers must not answer as a missing
+// name.
+func (autodns *Autodns) get(key string, z *Zone) (*Record, error) {
 	var label string
 	if key == z.Name {
 		label = "@"
@@ -434,21 +463,33 @@ func (autodns *Autodns) get(key string, z *Zone) *Record {
 		label = key
 	}
 
-	reply, err = conn.Do("HGET", autodns.keyPrefix+z.Name+autodns.keySuffix, label)
+	if r, ok := z.cachedRecord(label); ok {
+		return r, nil
+	}
+
+	conn := autodns.Pool.Get()
+	if conn == nil {
+		return nil, errors.New("error connecting to redis")
+	}
+	defer conn.Close()
+
+	reply, err := conn.Do("HGET", autodns.keyPrefix+z.Name+autodns.keySuffix, label)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
 	}
-	val, err = redisCon.String(reply, nil)
+	val, err := redisCon.String(reply, nil)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	r := new(Record)
-	err = json.Unmarshal([]byte(val), r)
-	if err != nil {
-		fmt.Println("parse error : ", val, err)
-		return nil
+	if err := json.Unmarshal([]byte(val), r); err != nil {
+		return nil, fmt.Errorf("parse error in %s of %s: %w", label, z.Name, err)
 	}
-	return r
+	z.cacheRecord(label, r)
+	return r, nil
 }
 
 func keyExists(key string, z *Zone) bool {
@@ -456,33 +497,19 @@ func keyExists(key string, z *Zone) bool {
 	return ok
 }
 
-func keyMatches(key string, z *Zone) bool {
-	for value := range z.Locations {
-		if strings.HasSuffix(value, key) {
-			return true
-		}
-	}
-	return false
-}
-
-func splitQuery(query string) (string, string, bool) {
-	if query == "" {
-		return "", "", false
+// isEmptyNonTerminal reports whether name has no record of its own while
+// names below it do, or is synthesized from a wildcard that is itself such a
+// name. Either way the name exists (RFC 8020, RFC 4592 4.1) and answers NODATA.
+func isEmptyNonTerminal(name string, z *Zone) bool {
+	labels, ok := relativeLabels(name, z)
+	if !ok || len(labels) == 0 {
+		return false
 	}
-	var (
-		splits            []string
-		closestEncloser   string
-		sourceOfSynthesis string
-	)
-	splits = strings.SplitAfterN(query, ".", 2)
-	if len(splits) == 2 {
-		closestEncloser = splits[1]
-		sourceOfSynthesis = "*." + closestEncloser
-	} else {
-		closestEncloser = ""
-		sourceOfSynthesis = "*"
+	exact, wildcard := z.labels().lookup(labels)
+	if exact != nil {
+		return !exact.data
 	}
-	return closestEncloser, sourceOfSynthesis, true
+	return wildcard != nil && !wildcard.data
 }
 
 func (autodns *Autodns) Connect() {
@@ -505,49 +532,60 @@ func (autodns *Autodns) Connect() {
 }
 
 func (autodns *Autodns) save(zone string, subdomain string, value string) error {
-	var err error
-
-	conn := autodns.Pool.Get()
-	if conn == nil {
-		fmt.Println("error connecting to redis")
-		return nil
-	}
-	defer conn.Close()
-
-	_, err = conn.Do("HSET", autodns.keyPrefix+zone+autodns.keySuffix, subdomain, value)
-	return err
+	return autodns.zoneWrite(zone, subdomain, value)
 }
 
-func (autodns *Autodns) load(zone string) *Zone {
+// load reads the field list and serial of zone. A zone without fields loads
+// empty; an error means Redis could not be read.
+func (autodns *Autodns) load(zone string) (*Zone, error) {
 	var (
 		reply interface{}
 		err   error
 		vals  []string
+		gen   uint64
 	)
 
+	cache := autodns.zoneCache
+	if cache != nil && cache.active.Load() {
+		var z *Zone
+		if z, gen = cache.lookup(zone); z != nil {
+			autodns.stats.cacheHits.Add(1)
+			return z, nil
+		}
+		autodns.stats.cacheMisses.Add(1)
+	} else {
+		cache = nil
+	}
+
 	conn := autodns.Pool.Get()
 	if conn == nil {
-		fmt.Println("error connecting to redis")
-		return nil
+		return nil, errors.New("error connecting to redis")
 	}
 	defer conn.Close()
 
 	reply, err = conn.Do("HKEYS", autodns.keyPrefix+zone+autodns.keySuffix)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	z := new(Zone)
 	z.Name = zone
 	vals, err = redisCon.Strings(reply, nil)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	z.Locations = make(map[string]struct{})
 	for _, val := range vals {
 		z.Locations[val] = struct{}{}
 	}
+	z.records = make(map[string]*Record)
+	if z.Serial, err = autodns.zoneSerial(conn, zone); err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		cache.store(z, gen)
+	}
 
-	return z
+	return z, nil
 }
 
 func split255(s string) []string {
@@ -571,12 +609,12 @@ func split255(s string) []string {
 }
 
 const (
-	defaultTtl       = 360
-	defaultAcmeRrTtl  = 120
-	defaultAcmeRotate = 5
-	hostmaster        = "hostmaster"
-	zoneUpdateTime = 10 * time.Minute
-	transferLength = 1000
+	defaultTtl           = 360
+	defaultAcmeRrTtl     = 120
+	defaultAcmeRotate    = 5
+	defaultAcmeDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+	hostmaster           = "hostmaster"
+	maxCnameChain        = 8
 )
 
 func contains(slice []string, item string) bool {
@@ -157,32 +157,6 @@ func TestSplit255(t *testing.T) {
 	}
 }
 
-func TestSplitQuery(t *testing.T) {
-	tests := []struct {
-		name              string
-		query             string
-		wantEncloser      string
-		wantSynthesis     string
-		wantOk            bool
-	}{
-		{name: "empty", query: "", wantEncloser: "", wantSynthesis: "", wantOk: false},
-		{name: "single label", query: "foo", wantEncloser: "", wantSynthesis: "*", wantOk: true},
-		{name: "multi label", query: "bar.sub.foo", wantEncloser: "sub.foo", wantSynthesis: "*.sub.foo", wantOk: true},
-	}
-
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			ce, ss, ok := splitQuery(tc.query)
-			if ok != tc.wantOk {
-				t.Fatalf("ok = %v, want %v", ok, tc.wantOk)
-			}
-			if ce != tc.wantEncloser || ss != tc.wantSynthesis {
-				t.Fatalf("splitQuery(%q) = (%q, %q), want (%q, %q)", tc.query, ce, ss, tc.wantEncloser, tc.wantSynthesis)
-			}
-		})
-	}
-}
-
 func exampleLocations() map[string]struct{} {
 	return map[string]struct{}{
 		"@":     {},
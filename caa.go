@@ -0,0 +1,66 @@
+package autodns
+
+import "strings"
+
+// caaIssuer is one CA allowed by acme.caa, optionally bound to an ACME
+// account (RFC 8657).
+type caaIssuer struct {
+	Domain     string
+	AccountURI string
+}
+
+// value renders the CAA property value. persist also allows dns-persist-01,
+// which acme.persist relies on.
+func (issuer caaIssuer) value(persist bool) string {
+	parts := []string{issuer.Domain}
+	if issuer.AccountURI != "" {
+		parts = append(parts, "accounturi="+issuer.AccountURI)
+	}
+	if persist {
+		parts = append(parts, "validationmethods=dns-01,dns-persist-01")
+	} else {
+		parts = append(parts, "validationmethods=dns-01")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// managedCAA returns the CAA records generated from acme.caa for the zone apex
+// and for names holding registered addresses.
+func (autodns *Autodns) managedCAA(name string, z *Zone, record *Record) []CAA_Record {
+	if len(autodns.AcmeCaa) == 0 {
+		return nil
+	}
+	if name != z.Name && (record == nil || (len(record.A) == 0 && len(record.AAAA) == 0)) {
+		return nil
+	}
+	persist := len(autodns.AcmePersist) > 0
+	out := make([]CAA_Record, 0, 2*len(autodns.AcmeCaa)+1)
+	for _, issuer := range autodns.AcmeCaa {
+		out = append(out, CAA_Record{Tag: "issue", Value: issuer.value(persist)})
+	}
+	for _, issuer := range autodns.AcmeCaa {
+		out = append(out, CAA_Record{Tag: "issuewild", Value: issuer.value(persist)})
+	}
+	if autodns.AcmeCaaIodef != "" {
+		out = append(out, CAA_Record{Tag: "iodef", Value: autodns.AcmeCaaIodef})
+	}
+	return out
+}
+
+// mergeCAA appends managed records to the stored ones, skipping duplicates.
+func mergeCAA(stored, managed []CAA_Record) []CAA_Record {
+	out := append([]CAA_Record(nil), stored...)
+	for _, m := range managed {
+		duplicate := false
+		for _, s := range stored {
+			if s.Flag == m.Flag && strings.EqualFold(s.Tag, m.Tag) && s.Value == m.Value {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			out = append(out, m)
+		}
+	}
+	return out
+}
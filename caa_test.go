@@ -0,0 +1,127 @@
+package autodns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const testAccountURI = "https://acme-v02.api.letsencrypt.org/acme/acct/123"
+
+func TestManagedCAA(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	a.AcmeCaa = []caaIssuer{{Domain: "letsencrypt.org", AccountURI: testAccountURI}}
+	a.AcmeCaaIodef = "mailto:security@example.net"
+	mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, "host2",
+		`{"a":[{"ttl":300,"ip":"5.5.5.6"}],"caa":[{"ttl":30,"flag":0,"tag":"issue","value":"letsencrypt.org"}]}`)
+
+	managed := "letsencrypt.org; accounturi=" + testAccountURI + "; validationmethods=dns-01"
+	tests := []test.Case{
+		{
+			Qname: "example.net.", Qtype: dns.TypeCAA,
+			Answer: []dns.RR{
+				test.CAA(`example.net. 300 IN CAA 0 issue "` + managed + `"`),
+				test.CAA(`example.net. 300 IN CAA 0 issuewild "` + managed + `"`),
+				test.CAA(`example.net. 300 IN CAA 0 iodef "mailto:security@example.net"`),
+			},
+		},
+		{
+			Qname: "host2.example.net.", Qtype: dns.TypeCAA,
+			Answer: []dns.RR{
+				test.CAA(`host2.example.net. 30 IN CAA 0 issue "letsencrypt.org"`),
+				test.CAA(`host2.example.net. 300 IN CAA 0 issue "` + managed + `"`),
+				test.CAA(`host2.example.net. 300 IN CAA 0 issuewild "` + managed + `"`),
+				test.CAA(`host2.example.net. 300 IN CAA 0 iodef "mailto:security@example.net"`),
+			},
+		},
+		{
+			// not a registered host: nothing managed, nothing stored
+			Qname: "foo.example.net.", Qtype: dns.TypeCAA,
+			Ns: []dns.RR{test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 303 44 55 66 100")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Qname, func(t *testing.T) {
+			resp := serveDNS(t, a, "127.0.0.1", tc.Qname, tc.Qtype)
+			if err := test.SortAndCheck(resp, tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMergeCAA(t *testing.T) {
+	stored := []CAA_Record{{Tag: "issue", Value: "letsencrypt.org; validationmethods=dns-01"}}
+	managed := []CAA_Record{
+		{Tag: "issue", Value: "letsencrypt.org; validationmethods=dns-01"},
+		{Tag: "issuewild", Value: "letsencrypt.org; validationmethods=dns-01"},
+	}
+	if got := mergeCAA(stored, managed); len(got) != 2 {
+		t.Fatalf("mergeCAA = %v, want duplicate dropped", got)
+	}
+	if got := (caaIssuer{Domain: "pki.goog"}).value(false); got != "pki.goog; validationmethods=dns-01" {
+		t.Fatalf("value = %q", got)
+	}
+	if got := (caaIssuer{Domain: "pki.goog"}).value(true); got != "pki.goog; validationmethods=dns-01,dns-persist-01" {
+		t.Fatalf("value with persist = %q", got)
+	}
+}
+
+func TestManagedCAAWithPersist(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.caa letsencrypt.org %s
+		acme.persist letsencrypt.org %s
+	}`, mr.Addr(), testAccountURI, testAccountURI))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	seedExampleZone(t, mr, a)
+
+	managed := "letsencrypt.org; accounturi=" + testAccountURI + "; validationmethods=dns-01,dns-persist-01"
+	tc := test.Case{
+		Qname: "example.net.", Qtype: dns.TypeCAA,
+		Answer: []dns.RR{
+			test.CAA(`example.net. 300 IN CAA 0 issue "` + managed + `"`),
+			test.CAA(`example.net. 300 IN CAA 0 issuewild "` + managed + `"`),
+		},
+	}
+	resp := serveDNS(t, a, "127.0.0.1", tc.Qname, tc.Qtype)
+	if err := test.SortAndCheck(resp, tc); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcmeCaaSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.caa LetsEncrypt.org. %s
+		acme.caa pki.goog
+		acme.caa.iodef mailto:security@example.net
+	}`, mr.Addr(), testAccountURI))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if len(a.AcmeCaa) != 2 || a.AcmeCaa[0].Domain != "letsencrypt.org" || a.AcmeCaa[0].AccountURI != testAccountURI || a.AcmeCaa[1].AccountURI != "" {
+		t.Fatalf("AcmeCaa = %+v", a.AcmeCaa)
+	}
+	if a.AcmeCaaIodef != "mailto:security@example.net" {
+		t.Fatalf("AcmeCaaIodef = %q", a.AcmeCaaIodef)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.caa
+	}`, mr.Addr()))
+	if _, err := redisSetup(c); err == nil {
+		t.Fatal("expected error without issuer")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// agent registers one hostname on every nameserver of its zone.
+type agent struct {
+	name        string
+	zone        string
+	resolver    string
+	nameservers []string
+	forceTCP    bool
+	timeout     time.Duration
+}
+
+// result is the outcome of registering on one nameserver.
+type result struct {
+	nameserver string
+	addresses  []string
+	err        error
+}
+
+func (a *agent) exchange(server string, m *dns.Msg) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: a.timeout}
+	if a.forceTCP {
+		c.Net = "tcp"
+	}
+	resp, _, err := c.Exchange(m, server)
+	if err == nil && resp.Truncated && c.Net != "tcp" {
+		c.Net = "tcp"
+		resp, _, err = c.Exchange(m, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *agent) query(server, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = false
+	return a.exchange(server, m)
+}
+
+// discover resolves the zone's NS RRset into nameserver addresses.
+func (a *agent) discover() ([]string, error) {
+	if len(a.nameservers) > 0 {
+		return a.nameservers, nil
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(a.zone), dns.TypeNS)
+	resp, err := a.exchange(a.resolver, m)
+	if err != nil {
+		return nil, err
+	}
+	var servers []string
+	for _, rr := range resp.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		addrs, err := a.resolve(ns.Ns)
+		if err != nil {
+			log.Printf("resolving nameserver %s: %v", ns.Ns, err)
+			continue
+		}
+		for _, addr := range addrs {
+			servers = append(servers, net.JoinHostPort(addr, "53"))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no nameservers found for %s", a.zone)
+	}
+	sort.Strings(servers)
+	return servers, nil
+}
+
+func (a *agent) resolve(host string) ([]string, error) {
+	var addrs []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(host), qtype)
+		resp, err := a.exchange(a.resolver, m)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addresses(resp)...)
+	}
+	return addrs, nil
+}
+
+func addresses(resp *dns.Msg) []string {
+	var addrs []string
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addrs = append(addrs, rr.A.String())
+		case *dns.AAAA:
+			addrs = append(addrs, rr.AAAA.String())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// register sends the _reg. query to one nameserver and reads back the addresses it serves.
+func (a *agent) register(server string) result {
+	res := result{nameserver: server}
+	resp, err := a.query(server, "_reg."+a.name, dns.TypeTXT)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		res.err = fmt.Errorf("registration refused: %s", dns.RcodeToString[resp.Rcode])
+		return res
+	}
+	want := strings.TrimSuffix(dns.Fqdn(a.name), ".")
+	if !txtContains(resp, want) {
+		res.err = fmt.Errorf("unexpected registration answer %v", resp.Answer)
+		return res
+	}
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := a.query(server, a.name, qtype)
+		if err != nil {
+			res.err = err
+			return res
+		}
+		res.addresses = append(res.addresses, addresses(resp)...)
+	}
+	sort.Strings(res.addresses)
+	if len(res.addresses) == 0 {
+		res.err = errors.New("no address served after registration")
+	}
+	return res
+}
+
+func txtContains(resp *dns.Msg, want string) bool {
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// run registers on all nameservers and fails when any of them errors or disagrees.
+func (a *agent) run() error {
+	servers, err := a.discover()
+	if err != nil {
+		return err
+	}
+	results := make([]result, 0, len(servers))
+	for _, server := range servers {
+		res := a.register(server)
+		if res.err != nil {
+			log.Printf("ERROR %s: %v", server, res.err)
+		} else {
+			log.Printf("registered %s at %s: %s", a.name, server, strings.Join(res.addresses, ","))
+		}
+		results = append(results, res)
+	}
+	return compare(results)
+}
+
+func compare(results []result) error {
+	var failed []string
+	var reference *result
+	for i := range results {
+		res := &results[i]
+		if res.err != nil {
+			failed = append(failed, res.nameserver)
+			continue
+		}
+		if reference == nil {
+			reference = res
+			continue
+		}
+		if strings.Join(res.addresses, ",") != strings.Join(reference.addresses, ",") {
+			log.Printf("ERROR nameservers disagree: %s serves %v, %s serves %v",
+				reference.nameserver, reference.addresses, res.nameserver, res.addresses)
+			failed = append(failed, res.nameserver)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("registration failed or disagrees on %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// interfaceAddrs returns a stable fingerprint of the local interface addresses.
+func interfaceAddrs() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	list := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		list = append(list, addr.String())
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeNameserver answers _reg. and address queries like autodns would.
+type fakeNameserver struct {
+	addr     string
+	served   string
+	truncate bool
+}
+
+func (f *fakeNameserver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	if f.truncate && w.LocalAddr().Network() == "udp" {
+		m.Truncated = true
+		_ = w.WriteMsg(m)
+		return
+	}
+	switch {
+	case q.Qtype == dns.TypeTXT && strings.HasPrefix(q.Name, "_reg."):
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{strings.TrimSuffix(strings.TrimPrefix(q.Name, "_reg."), ".")},
+		})
+	case q.Qtype == dns.TypeA:
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(f.served),
+		})
+	}
+	_ = w.WriteMsg(m)
+}
+
+func startFakeNameserver(t *testing.T, f *fakeNameserver) string {
+	t.Helper()
+
+	ln, pc := listenTCPAndUDP(t)
+	udp := &dns.Server{PacketConn: pc, Handler: f}
+	tcp := &dns.Server{Listener: ln, Handler: f}
+	go func() { _ = udp.ActivateAndServe() }()
+	go func() { _ = tcp.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udp.Shutdown()
+		_ = tcp.Shutdown()
+	})
+	f.addr = ln.Addr().String()
+	return f.addr
+}
+
+// listenTCPAndUDP binds TCP on a free port and UDP on the same port. The
+// UDP port can be taken in between, so that is retried on a new port.
+func listenTCPAndUDP(t *testing.T) (net.Listener, net.PacketConn) {
+	t.Helper()
+
+	for attempt := 0; attempt < 10; attempt++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := net.ListenPacket("udp", ln.Addr().String())
+		if err == nil {
+			return ln, pc
+		}
+		ln.Close()
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("no port free for both TCP and UDP")
+	return nil, nil
+}
+
+func testAgent(servers ...string) *agent {
+	return &agent{
+		name:        "host1.example.com.",
+		zone:        "example.com.",
+		nameservers: servers,
+		timeout:     time.Second,
+	}
+}
+
+func TestAgentRunAgreement(t *testing.T) {
+	ns1 := startFakeNameserver(t, &fakeNameserver{served: "100.64.0.10"})
+	ns2 := startFakeNameserver(t, &fakeNameserver{served: "100.64.0.10"})
+
+	if err := testAgent(ns1, ns2).run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+}
+
+func TestAgentRunDisagreement(t *testing.T) {
+	ns1 := startFakeNameserver(t, &fakeNameserver{served: "100.64.0.10"})
+	ns2 := startFakeNameserver(t, &fakeNameserver{served: "100.64.0.99"})
+
+	err := testAgent(ns1, ns2).run()
+	if err == nil || !strings.Contains(err.Error(), ns2) {
+		t.Fatalf("run error = %v, want disagreement on %s", err, ns2)
+	}
+}
+
+func TestAgentTCPFallback(t *testing.T) {
+	ns1 := startFakeNameserver(t, &fakeNameserver{served: "100.64.0.10", truncate: true})
+
+	res := testAgent(ns1).register(ns1)
+	if res.err != nil {
+		t.Fatalf("register: %v", res.err)
+	}
+	if len(res.addresses) != 1 || res.addresses[0] != "100.64.0.10" {
+		t.Fatalf("addresses = %v", res.addresses)
+	}
+}
+
+func TestAgentUnreachable(t *testing.T) {
+	ns1 := startFakeNameserver(t, &fakeNameserver{served: "100.64.0.10"})
+	a := testAgent(ns1, "127.0.0.1:1")
+	a.timeout = 200 * time.Millisecond
+
+	if err := a.run(); err == nil {
+		t.Fatal("expected error for unreachable nameserver")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	results := []result{
+		{nameserver: "ns1", addresses: []string{"1.1.1.1"}},
+		{nameserver: "ns2", addresses: []string{"1.1.1.1"}},
+	}
+	if err := compare(results); err != nil {
+		t.Fatalf("compare: %v", err)
+	}
+	results[1].addresses = []string{"2.2.2.2"}
+	if err := compare(results); err == nil {
+		t.Fatal("expected disagreement error")
+	}
+}
+
+type fakeResolver struct{}
+
+func (fakeResolver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	q := r.Question[0]
+	switch q.Qtype {
+	case dns.TypeNS:
+		for _, ns := range []string{"ns1.example.com.", "ns2.example.com."} {
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+				Ns:  ns,
+			})
+		}
+	case dns.TypeA:
+		ip := "192.0.2.1"
+		if q.Name == "ns2.example.com." {
+			ip = "192.0.2.2"
+		}
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+	}
+	_ = w.WriteMsg(m)
+}
+
+func TestAgentDiscover(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: fakeResolver{}}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	a := testAgent()
+	a.resolver = pc.LocalAddr().String()
+	servers, err := a.discover()
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	want := "192.0.2.1:53,192.0.2.2:53"
+	if got := strings.Join(servers, ","); got != want {
+		t.Fatalf("servers = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+// Command autodns-agent registers a host on every nameserver of an autodns
+// zone and keeps the registration fresh.
+//
+//	autodns-agent -name host1.example.com -interval 5m
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func main() {
+	var (
+		name        = flag.String("name", "", "fully qualified hostname to register (required)")
+		zone        = flag.String("zone", "", "zone of the hostname, default strips the first label of -name")
+		nameservers = flag.String("ns", "", "comma separated nameserver addresses, default discovers the zone NS RRset")
+		resolver    = flag.String("resolver", "", "resolver used for nameserver discovery, default from /etc/resolv.conf")
+		interval    = flag.Duration("interval", 5*time.Minute, "re-registration interval")
+		watch       = flag.Duration("watch", 10*time.Second, "interface address polling interval")
+		forceTCP    = flag.Bool("tcp", false, "always use TCP")
+		timeout     = flag.Duration("timeout", 5*time.Second, "per-query timeout")
+		once        = flag.Bool("once", false, "register once and exit non-zero on any failure")
+	)
+	flag.Parse()
+
+	if *name == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	a := &agent{
+		name:     dns.Fqdn(*name),
+		zone:     *zone,
+		forceTCP: *forceTCP,
+		timeout:  *timeout,
+	}
+	if a.zone == "" {
+		labels := dns.SplitDomainName(a.name)
+		if len(labels) < 2 {
+			log.Fatalf("cannot derive zone from %q, use -zone", *name)
+		}
+		a.zone = strings.Join(labels[1:], ".")
+	}
+	a.zone = dns.Fqdn(a.zone)
+	for _, ns := range strings.Split(*nameservers, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			if _, _, err := net.SplitHostPort(ns); err != nil {
+				ns = net.JoinHostPort(ns, "53")
+			}
+			a.nameservers = append(a.nameservers, ns)
+		}
+	}
+	if len(a.nameservers) == 0 {
+		a.resolver = *resolver
+		if a.resolver == "" {
+			conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+			if err != nil || len(conf.Servers) == 0 {
+				log.Fatalf("no resolver configured, use -resolver or -ns: %v", err)
+			}
+			a.resolver = net.JoinHostPort(conf.Servers[0], conf.Port)
+		} else if _, _, err := net.SplitHostPort(a.resolver); err != nil {
+			a.resolver = net.JoinHostPort(a.resolver, "53")
+		}
+	}
+
+	if *once {
+		if err := a.run(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := a.run(); err != nil {
+		log.Print(err)
+	}
+	last := interfaceAddrs()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	poll := time.NewTicker(*watch)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-poll.C:
+			current := interfaceAddrs()
+			if current == last {
+				continue
+			}
+			log.Printf("interface addresses changed, re-registering")
+			last = current
+		}
+		if err := a.run(); err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package autodns
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// findDelegation returns the topmost non-apex name at or above qname holding
+// an NS RRset, and its record.
+func (autodns *Autodns) findDelegation(qname string, z *Zone) (string, *Record, error) {
+	labels, ok := relativeLabels(qname, z)
+	if !ok {
+		return "", nil, nil
+	}
+	node := z.labels()
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node = node.children[labels[i]]; node == nil {
+			break
+		}
+		if !node.data {
+			continue
+		}
+		record, err := autodns.get(node.key, z)
+		if err != nil {
+			return "", nil, err
+		}
+		if record != nil && len(record.NS) > 0 {
+			return strings.Join(labels[i:], ".") + "." + z.Name, record, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// glue returns the A/AAAA records of an in-bailiwick nameserver host.
+func (autodns *Autodns) glue(host string, z *Zone) []dns.RR {
+	host = strings.ToLower(dns.Fqdn(host))
+	if !strings.HasSuffix(host, "."+z.Name) {
+		return nil
+	}
+	label := strings.TrimSuffix(host, "."+z.Name)
+	if !keyExists(label, z) {
+		return nil
+	}
+	record, _ := autodns.get(label, z)
+	if record == nil {
+		return nil
+	}
+	a, _ := autodns.A(host, z, record)
+	aaaa, _ := autodns.AAAA(host, z, record)
+	return append(a, aaaa...)
+}
+
+// referral writes a non-authoritative referral to the delegated zone at cut.
+func (autodns *Autodns) referral(state request.Request, cut string, z *Zone, record *Record) (int, error) {
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative, m.RecursionAvailable, m.Compress = false, false, true
+
+	m.Ns, _ = autodns.NS(cut, z, record)
+	for _, ns := range record.NS {
+		m.Extra = append(m.Extra, autodns.glue(ns.Host, z)...)
+	}
+
+	state.SizeAndDo(m)
+	m = state.Scrub(m)
+	_ = state.W.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
@@ -0,0 +1,93 @@
+package autodns
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSReferral(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	mr.HSet(zoneKey, "ns1.subdel", `{"a":[{"ttl":300,"ip":"192.0.2.53"}],"aaaa":[{"ttl":300,"ip":"2001:db8::53"}]}`)
+	mr.HSet(zoneKey, "host.subdel", `{"a":[{"ttl":300,"ip":"192.0.2.80"}]}`)
+	mr.HSet(zoneKey, "secure", `{"ns":[{"ttl":300,"host":"ns.other.org."}],"ds":[{"ttl":300,"keytag":12345,"algorithm":13,"digesttype":2,"digest":"abcdef0123456789"}]}`)
+
+	referral := []dns.RR{
+		test.NS("subdel.example.net. 300 IN NS ns1.subdel.example.net."),
+		test.NS("subdel.example.net. 300 IN NS ns2.subdel.example.net."),
+	}
+	glue := []dns.RR{
+		test.A("ns1.subdel.example.net. 300 IN A 192.0.2.53"),
+		test.AAAA("ns1.subdel.example.net. 300 IN AAAA 2001:db8::53"),
+	}
+	tests := []test.Case{
+		{Qname: "subdel.example.net.", Qtype: dns.TypeNS, Ns: referral, Extra: glue},
+		{Qname: "host.subdel.example.net.", Qtype: dns.TypeA, Ns: referral, Extra: glue},
+		{Qname: "deep.below.subdel.example.net.", Qtype: dns.TypeTXT, Ns: referral, Extra: glue},
+		{Qname: "secure.example.net.", Qtype: dns.TypeA, Ns: []dns.RR{test.NS("secure.example.net. 300 IN NS ns.other.org.")}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Qname, func(t *testing.T) {
+			resp := serveDNS(t, a, "127.0.0.1", tc.Qname, tc.Qtype)
+			if resp.Authoritative {
+				t.Fatal("referral must not be authoritative")
+			}
+			if err := test.SortAndCheck(resp, tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestServeDNSDelegationDS(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	mr.HSet(zoneKey, "secure", `{"ns":[{"ttl":300,"host":"ns.other.org."}],"ds":[{"ttl":300,"keytag":12345,"algorithm":13,"digesttype":2,"digest":"abcdef0123456789"}]}`)
+
+	resp := serveDNS(t, a, "127.0.0.1", "secure.example.net.", dns.TypeDS)
+	tc := test.Case{
+		Qname: "secure.example.net.", Qtype: dns.TypeDS,
+		Answer: []dns.RR{test.DS("secure.example.net. 300 IN DS 12345 13 2 ABCDEF0123456789")},
+	}
+	if !resp.Authoritative {
+		t.Fatal("DS at the cut must be answered authoritatively")
+	}
+	if err := test.SortAndCheck(resp, tc); err != nil {
+		t.Error(err)
+	}
+
+	// without DS the parent answers NODATA, not a referral
+	resp = serveDNS(t, a, "127.0.0.1", "subdel.example.net.", dns.TypeDS)
+	if !resp.Authoritative || len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("DS without records = %v, want authoritative NODATA", resp)
+	}
+
+	// DS below the cut belongs to the child
+	resp = serveDNS(t, a, "127.0.0.1", "host.subdel.example.net.", dns.TypeDS)
+	if resp.Authoritative || len(resp.Ns) != 2 {
+		t.Fatalf("DS below cut = %v, want referral", resp)
+	}
+}
+
+func TestFindDelegationReadsOnce(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	z, err := a.load(exampleZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, delegation, err := a.findDelegation("host1."+exampleZone, z); delegation != nil || err != nil {
+		t.Fatalf("findDelegation = %v, %v", delegation, err)
+	}
+
+	// the answer is built from the record the delegation walk already read
+	before := mr.CommandCount()
+	record, err := a.get("host1", z)
+	if err != nil || record == nil || len(record.A) == 0 {
+		t.Fatalf("get(host1) = %v, %v", record, err)
+	}
+	if n := mr.CommandCount() - before; n != 0 {
+		t.Fatalf("get sent %d redis commands, want none", n)
+	}
+}
@@ -0,0 +1,155 @@
+package autodns
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	dyndnsUpdatePath = "/nic/update"
+	dyndnsAccountKey = "_autodns:dyndns"
+)
+
+// dyndnsAccount is stored as JSON in the dyndns hash, one field per username.
+type dyndnsAccount struct {
+	Password string   `json:"password"`
+	Hosts    []string `json:"hosts"`
+}
+
+func (account *dyndnsAccount) allows(hostname string) bool {
+	for _, host := range account.Hosts {
+		if UniformZone(host) == hostname {
+			return true
+		}
+	}
+	return false
+}
+
+func (autodns *Autodns) dyndnsKey() string {
+	return autodns.keyPrefix + dyndnsAccountKey + autodns.keySuffix
+}
+
+func (autodns *Autodns) dyndnsAccount(username string) (*dyndnsAccount, error) {
+	conn := autodns.Pool.Get()
+	if conn == nil {
+		return nil, errors.New("error connecting to redis")
+	}
+	defer conn.Close()
+
+	val, err := redis.String(conn.Do("HGET", autodns.dyndnsKey(), username))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	account := new(dyndnsAccount)
+	if err := json.Unmarshal([]byte(val), account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (autodns *Autodns) startDyndns() error {
+	srv, err := listenHTTP("DynDNS2", autodns.DyndnsListen, autodns.dyndnsHandler())
+	autodns.dyndnsServer = srv
+	return err
+}
+
+func (autodns *Autodns) stopDyndns() error {
+	return shutdownHTTP(autodns.dyndnsServer)
+}
+
+func (autodns *Autodns) dyndnsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dyndnsUpdatePath, autodns.serveDyndnsUpdate)
+	return mux
+}
+
+func (autodns *Autodns) serveDyndnsUpdate(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="autodns"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("badauth\n"))
+		return
+	}
+	account, err := autodns.dyndnsAccount(username)
+	if err != nil {
+		logger.Error(`DynDNS2 error loading account `, username, ` error: `, err)
+		_, _ = w.Write([]byte("911\n"))
+		return
+	}
+	if account == nil || bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(password)) != nil {
+		logger.Warning(`DynDNS2 authentication failed for `, username, ` from `, req.RemoteAddr)
+		_, _ = w.Write([]byte("badauth\n"))
+		return
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(req.URL.Query().Get("myip")))
+	if ip == nil {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		_, _ = w.Write([]byte("911\n"))
+		return
+	}
+
+	hostnames := strings.Split(req.URL.Query().Get("hostname"), ",")
+	results := make([]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		results = append(results, autodns.dyndnsUpdate(account, username, strings.TrimSpace(hostname), ip))
+	}
+	_, _ = w.Write([]byte(strings.Join(results, "\n") + "\n"))
+}
+
+// dyndnsUpdate applies one hostname update and returns its dyndns2 result code.
+func (autodns *Autodns) dyndnsUpdate(account *dyndnsAccount, username, hostname string, ip net.IP) string {
+	if hostname == "" || !strings.Contains(strings.TrimSuffix(hostname, "."), ".") {
+		return "notfqdn"
+	}
+	hostname = UniformZone(hostname)
+	zone := plugin.Zones(autodns.zones()).Matches(hostname)
+	if zone == "" || hostname == zone || !account.allows(hostname) {
+		return "nohost"
+	}
+	subdomain := strings.TrimSuffix(hostname, "."+zone)
+	if autodns.subdomainBelongsToDeny(subdomain) {
+		logger.Warning(`DynDNS2 update for `, hostname, ` by `, username, ` denied because of register.deny setting`)
+		autodns.stats.registrationDenied.Add(1)
+		return "nohost"
+	}
+
+	record, err := autodns.readRecordField(zone, subdomain)
+	if err != nil {
+		logger.Error(`DynDNS2 error reading `, subdomain, ` error: `, err)
+		return "911"
+	}
+	if recordHasAddress(record, ip) {
+		return "nochg " + ip.String()
+	}
+	if err := autodns.AddRegisteredRecord(zone, subdomain, ip.String()); err != nil {
+		logger.Error(`DynDNS2 error adding record for `, subdomain, ` with ip `, ip, ` error: `, err)
+		return "911"
+	}
+	autodns.stats.registrations.Add(1)
+	logger.Info(`DynDNS2 update for `, hostname, ` by `, username, ` ip: `, ip)
+	return "good " + ip.String()
+}
+
+func recordHasAddress(record *Record, ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		return len(record.A) == 1 && record.A[0].Ip.Equal(v4)
+	}
+	return len(record.AAAA) == 1 && record.AAAA[0].Ip.Equal(ip)
+}
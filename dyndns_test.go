@@ -0,0 +1,172 @@
+package autodns
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func seedDyndnsAccount(t *testing.T, mr *miniredis.Miniredis, a *Autodns, username, password string, hosts ...string) {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := fmt.Sprintf(`{"password":%q,"hosts":["%s"]}`, hash, strings.Join(hosts, `","`))
+	mr.HSet(a.dyndnsKey(), username, value)
+}
+
+func dyndnsRequest(t *testing.T, a *Autodns, username, password, query string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, dyndnsUpdatePath+"?"+query, nil)
+	req.RemoteAddr = "192.0.2.10:40000"
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	rec := httptest.NewRecorder()
+	a.dyndnsHandler().ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestDyndnsUpdate(t *testing.T) {
+	a, mr := registrationAutodns(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	seedDyndnsAccount(t, mr, a, "router", "s3cret", "home.example.net", "www.example.net")
+
+	t.Run("good", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=home.example.net&myip=203.0.113.7")
+		if body != "good 203.0.113.7\n" {
+			t.Fatalf("body = %q", body)
+		}
+		if stored := mr.HGet(zoneKey, "home"); !strings.Contains(stored, "203.0.113.7") {
+			t.Fatalf("redis = %q", stored)
+		}
+	})
+
+	t.Run("nochg", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=home.example.net&myip=203.0.113.7")
+		if body != "nochg 203.0.113.7\n" {
+			t.Fatalf("body = %q", body)
+		}
+	})
+
+	t.Run("myip from remote address", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=home.example.net")
+		if body != "good 192.0.2.10\n" {
+			t.Fatalf("body = %q", body)
+		}
+	})
+
+	t.Run("IPv6", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=home.example.net&myip=2001:db8::7")
+		if body != "good 2001:db8::7\n" {
+			t.Fatalf("body = %q", body)
+		}
+		if stored := mr.HGet(zoneKey, "home"); !strings.Contains(stored, `"aaaa"`) {
+			t.Fatalf("redis = %q, want AAAA", stored)
+		}
+	})
+
+	t.Run("register.deny", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=www.example.net&myip=203.0.113.7")
+		if body != "nohost\n" {
+			t.Fatalf("body = %q", body)
+		}
+		if stored := mr.HGet(zoneKey, "www"); stored != "" {
+			t.Fatalf("denied host must not write redis, got %q", stored)
+		}
+	})
+
+	t.Run("host not in account", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=other.example.net&myip=203.0.113.7")
+		if body != "nohost\n" {
+			t.Fatalf("body = %q", body)
+		}
+	})
+
+	t.Run("zone not served", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=home.example.org&myip=203.0.113.7")
+		if body != "nohost\n" {
+			t.Fatalf("body = %q", body)
+		}
+	})
+
+	t.Run("not fqdn", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=home&myip=203.0.113.7")
+		if body != "notfqdn\n" {
+			t.Fatalf("body = %q", body)
+		}
+	})
+
+	t.Run("multiple hostnames", func(t *testing.T) {
+		_, body := dyndnsRequest(t, a, "router", "s3cret", "hostname=home.example.net,other.example.net&myip=203.0.113.8")
+		if body != "good 203.0.113.8\nnohost\n" {
+			t.Fatalf("body = %q", body)
+		}
+	})
+}
+
+func TestDyndnsAuth(t *testing.T) {
+	a, mr := registrationAutodns(t)
+	seedDyndnsAccount(t, mr, a, "router", "s3cret", "home.example.net")
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantCode int
+	}{
+		{name: "missing credentials", wantCode: http.StatusUnauthorized},
+		{name: "wrong password", username: "router", password: "nope", wantCode: http.StatusOK},
+		{name: "unknown user", username: "nobody", password: "s3cret", wantCode: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, body := dyndnsRequest(t, a, tc.username, tc.password, "hostname=home.example.net&myip=203.0.113.7")
+			if code != tc.wantCode || body != "badauth\n" {
+				t.Fatalf("got %d %q, want %d badauth", code, body, tc.wantCode)
+			}
+		})
+	}
+	if stored := mr.HGet(a.keyPrefix+exampleZone+a.keySuffix, "home"); stored != "" {
+		t.Fatalf("unauthenticated update wrote redis: %q", stored)
+	}
+}
+
+func TestDyndnsAccountKeyIsNotAZone(t *testing.T) {
+	a, mr := registrationAutodns(t)
+	seedDyndnsAccount(t, mr, a, "router", "s3cret", "home.example.net")
+
+	a.LoadZones()
+	for _, zone := range a.zones() {
+		if zone != exampleZone {
+			t.Fatalf("unexpected zone %q in %v", zone, a.zones())
+		}
+	}
+}
+
+func TestDyndnsSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	corefile := fmt.Sprintf(`autodns {
+		address %s
+		dyndns.listen 127.0.0.1:8053
+	}`, mr.Addr())
+
+	c := caddy.NewTestController("dns", corefile)
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if a.DyndnsListen != "127.0.0.1:8053" {
+		t.Fatalf("DyndnsListen = %q", a.DyndnsListen)
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/coredns/coredns v1.12.0
 	github.com/gomodule/redigo v1.9.3
 	github.com/miekg/dns v1.1.63
+	golang.org/x/crypto v0.31.0
 	golang.org/x/net v0.33.0
 )
 
@@ -33,7 +34,6 @@ require (
 	github.com/quic-go/quic-go v0.48.1 // indirect
 	github.com/yuin/gopher-lua v1.1.1 // indirect
 	go.uber.org/mock v0.4.0 // indirect
-	golang.org/x/crypto v0.31.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/mod v0.18.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
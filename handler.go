@@ -6,7 +6,6 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/request"
@@ -30,14 +29,7 @@ func (autodns *Autodns) AddRegisteredRecord(zone string, subdomain string, ip st
 }
 
 func (autodns *Autodns) addRecord(zone string, subdomain string, value string) error {
-	conn := autodns.Pool.Get()
-	if conn == nil {
-		return errors.New("error connecting to redis")
-	}
-	defer conn.Close()
-
-	_, err := conn.Do("HSET", autodns.keyPrefix+zone+autodns.keySuffix, subdomain, value)
-	if err != nil {
+	if err := autodns.zoneWrite(zone, subdomain, value); err != nil {
 		return err
 	}
 	logger.Info(`Added record to redis for `, subdomain, ` value `, value)
@@ -60,53 +52,51 @@ func (autodns *Autodns) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 		logger.Info(fmt.Sprintf("%s - [query] '%s' '%s'", clientIP, qtype, qname))
 	}
 
-	if time.Since(autodns.LastZoneUpdate) > zoneUpdateTime {
-		autodns.LoadZones()
+	if len(autodns.ChaosNetworks) > 0 && isChaosQuery(state) {
+		return autodns.handleChaos(state, clientIP)
+	}
+
+	if qtype == "TXT" {
+		if d := autodns.matchAcmeDelegation(qname); d != nil {
+			return autodns.handleAcmeDelegation(d, originalQname, clientIP, r, &state, w)
+		}
 	}
 
 	// we need to be responsible for the zone
-	zone := plugin.Zones(autodns.Zones).Matches(qname)
+	zone := plugin.Zones(autodns.zones()).Matches(qname)
 	if zone == "" {
 		return plugin.NextOrFailure(qname, autodns.Next, ctx, w, r)
 	}
 
-	// load the zone from redis
-	z := autodns.load(zone)
-	if z == nil {
-		return autodns.errorResponse(state, zone, dns.RcodeServerFailure, nil)
+	if qtype == "TXT" && isWhoamiQuery(qname, zone) {
+		return autodns.handleWhoami(originalQname, zone, clientIP, r, &state, w)
 	}
 
-	if qtype == "AXFR" {
-
-		records := autodns.AXFR(z)
-
-		ch := make(chan *dns.Envelope)
-		tr := new(dns.Transfer)
-		tr.TsigSecret = nil
-
-		go func(ch chan *dns.Envelope) {
-			j, l := 0, 0
+	// zone transfers go through the transfer plugin, which calls Transfer
+	if qtype == "AXFR" || qtype == "IXFR" {
+		return autodns.errorResponse(state, zone, dns.RcodeRefused, edeNotAllowed, nil)
+	}
 
-			for i, r := range records {
-				l += dns.Len(r)
-				if l > transferLength {
-					ch <- &dns.Envelope{RR: records[j:i]}
-					l = 0
-					j = i
-				}
-			}
-			if j < len(records) {
-				ch <- &dns.Envelope{RR: records[j:]}
-			}
-			close(ch)
-		}(ch)
+	// load the zone from redis
+	z, err := autodns.load(zone)
+	if err != nil {
+		return autodns.errorResponse(state, zone, dns.RcodeServerFailure, edeNotReady, err)
+	}
 
-		err := tr.Out(w, r, ch)
-		if err != nil {
-			fmt.Println(err)
+	if qtype == "TXT" {
+		if hostLabel, ok := parseStatusQuery(qname, zone); ok {
+			return autodns.handleStatus(originalQname, zone, hostLabel, clientIP, z, r, &state, w)
 		}
-		w.Hijack()
-		return dns.RcodeSuccess, nil
+	}
+
+	// at or below a delegation point only the referral is ours; DS lives on
+	// the parent side of the cut and is answered from this zone
+	cut, delegation, err := autodns.findDelegation(qname, z)
+	if err != nil {
+		return autodns.errorResponse(state, zone, dns.RcodeServerFailure, edeNotReady, err)
+	}
+	if delegation != nil && !(qtype == "DS" && qname == cut) {
+		return autodns.referral(state, cut, z, delegation)
 	}
 
 	location := autodns.findLocation(qname, z)
@@ -128,22 +118,26 @@ func (autodns *Autodns) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 					subdomain := strings.TrimSuffix(fullhost, "."+zone)
 					if autodns.subdomainBelongsToDeny(subdomain) {
 						logger.Warning(`Registration request for `, qname, ` from `, clientIP, ` denied because of register.deny setting`)
-						return autodns.errorResponse(state, zone, dns.RcodeNameError, nil)
+						autodns.stats.registrationDenied.Add(1)
+						return autodns.errorResponse(state, zone, dns.RcodeNameError, edeDenied, nil)
 					}
 					logger.Info(`Registration request for fullhost: `, fullhost, ` subdomain: `, subdomain, ` ip: `, clientIP)
 					if err := autodns.AddRegisteredRecord(zone, subdomain, clientIP); err != nil {
 						logger.Error(`Error adding A record to redis for `, subdomain, ` with ip `, clientIP, ` and ttl `, autodns.Ttl, ` error: `, err)
+						return autodns.errorResponse(state, zone, dns.RcodeServerFailure, edeNotReady, err)
 					}
+					autodns.stats.registrations.Add(1)
 					logger.Info(`Registration success for `, qname, ` from `, clientIP)
 					if _, err := autodns.TXTReply(qname, []string{fmt.Sprintf("%s", strings.TrimSuffix(fullhost, "."))}, r, &state, w); err != nil {
 						logger.Error(`Error sending TXT reply for `, qname, ` error: `, err)
-						return autodns.errorResponse(state, zone, dns.RcodeServerFailure, err)
+						return autodns.errorResponse(state, zone, dns.RcodeServerFailure, nil, err)
 					}
 					return dns.RcodeSuccess, nil
 				}
 			} else {
 				logger.Warning(`Registration request for `, qname, ` from `, clientIP, ` not in register networks`)
-				return autodns.errorResponse(state, zone, dns.RcodeNameError, nil)
+				autodns.stats.registrationDenied.Add(1)
+				return autodns.errorResponse(state, zone, dns.RcodeNameError, edeNotAllowed, nil)
 			}
 		}
 
@@ -155,60 +149,224 @@ func (autodns *Autodns) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *d
 			return autodns.handleAcmeDeletion(originalQname, zone, clientIP, r, &state, w)
 		}
 
-		return autodns.errorResponse(state, zone, dns.RcodeNameError, nil)
+		if qtype == "TXT" && (strings.HasPrefix(qname, persistRegPrefix) || strings.HasPrefix(qname, persistWildPrefix) || strings.HasPrefix(qname, persistDelPrefix)) {
+			return autodns.handlePersist(originalQname, zone, clientIP, r, &state, w)
+		}
+
+		if qtype == "TXT" && strings.HasPrefix(qname, acmeCheckPrefix) {
+			return autodns.handleAcmeCheck(ctx, originalQname, zone, clientIP, r, &state, w)
+		}
+
+		if isEmptyNonTerminal(qname, z) {
+			return autodns.negativeResponse(state, z, dns.RcodeSuccess)
+		}
+		return autodns.negativeResponse(state, z, dns.RcodeNameError)
 	}
 
 	answers := make([]dns.RR, 0, 10)
 	extras := make([]dns.RR, 0, 10)
+	var authority []dns.RR
+
+	record, err := autodns.get(location, z)
+	if err != nil {
+		return autodns.errorResponse(state, zone, dns.RcodeServerFailure, edeNotReady, err)
+	}
+
+	if qtype == "ANY" {
+		answers, extras = autodns.anyAnswer(qname, clientIP, z, record)
+	} else if qtype != "CNAME" && record != nil && len(record.CNAME) > 0 {
+		if answers, extras, authority, err = autodns.chaseCNAME(qname, qtype, z, record); err != nil {
+			return autodns.errorResponse(state, zone, dns.RcodeServerFailure, edeNotReady, err)
+		}
+	} else {
+		var ok bool
+		if answers, extras, ok = autodns.answer(qtype, qname, z, record); !ok {
+			return autodns.errorResponse(state, zone, dns.RcodeNotImplemented, edeNotSupported, nil)
+		}
+	}
 
-	record := autodns.get(location, z)
+	if len(answers) == 0 {
+		return autodns.negativeResponse(state, z, dns.RcodeSuccess)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative, m.RecursionAvailable, m.Compress = true, false, true
+
+	m.Answer = append(m.Answer, answers...)
+	m.Extra = append(m.Extra, extras...)
+	m.Ns = authority
+	if autodns.AuthorityNS && len(authority) == 0 && !(qtype == "NS" && qname == z.Name) {
+		if apex, _ := autodns.get(z.Name, z); apex != nil {
+			ns, glue := autodns.NS(z.Name, z, apex)
+			m.Ns = append(m.Ns, ns...)
+			m.Extra = append(m.Extra, glue...)
+		}
+	}
+
+	state.SizeAndDo(m)
+	m = state.Scrub(m)
+	_ = w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
 
+// answer returns the RRset of qtype at name; ok is false for unsupported types.
+func (autodns *Autodns) answer(qtype, name string, z *Zone, record *Record) (answers, extras []dns.RR, ok bool) {
 	switch qtype {
 	case "A":
-		answers, extras = autodns.A(qname, z, record)
+		answers, extras = autodns.A(name, z, record)
 	case "AAAA":
-		answers, extras = autodns.AAAA(qname, z, record)
+		answers, extras = autodns.AAAA(name, z, record)
 	case "CNAME":
-		answers, extras = autodns.CNAME(qname, z, record)
+		answers, extras = autodns.CNAME(name, z, record)
 	case "TXT":
-		answers, extras = autodns.TXT(qname, z, record)
+		answers, extras = autodns.TXT(name, z, record)
 	case "NS":
-		answers, extras = autodns.NS(qname, z, record)
+		answers, extras = autodns.NS(name, z, record)
 	case "MX":
-		answers, extras = autodns.MX(qname, z, record)
+		answers, extras = autodns.MX(name, z, record)
 	case "SRV":
-		answers, extras = autodns.SRV(qname, z, record)
+		answers, extras = autodns.SRV(name, z, record)
 	case "SOA":
-		answers, extras = autodns.SOA(qname, z, record)
+		if name == z.Name {
+			answers, extras = autodns.SOA(name, z, record)
+		}
 	case "CAA":
-		answers, extras = autodns.CAA(qname, z, record)
-
+		answers, extras = autodns.CAA(name, z, record)
+	case "DS":
+		answers, extras = autodns.DS(name, z, record)
 	default:
-		return autodns.errorResponse(state, zone, dns.RcodeNotImplemented, nil)
+		return nil, nil, false
+	}
+	return answers, extras, true
+}
+
+// chaseCNAME answers a query at a CNAME owner: the CNAME, then the chain
+// through names in autodns zones, then the final RRset of qtype. A chain that
+// ends in one of our zones without that RRset carries the zone SOA in ns, as
+// for any NODATA answer (RFC 2308 section 2.2). External targets, loops and
+// chains longer than maxCnameChain end the chase; failing to read a zone on
+// the way is an error rather than a shorter chain.
+func (autodns *Autodns) chaseCNAME(name, qtype string, z *Zone, record *Record) (answers, extras, ns []dns.RR, err error) {
+	seen := map[string]bool{name: true}
+	for i := 0; ; i++ {
+		cnames, _ := autodns.CNAME(name, z, record)
+		if len(cnames) == 0 {
+			return
+		}
+		cname := cnames[0].(*dns.CNAME)
+		answers = append(answers, cname)
+
+		target := strings.ToLower(cname.Target)
+		if seen[target] || i+1 >= maxCnameChain {
+			return
+		}
+		seen[target] = true
+
+		targetZone := plugin.Zones(autodns.zones()).Matches(target)
+		if targetZone == "" {
+			return
+		}
+		if targetZone != z.Name {
+			if z, err = autodns.load(targetZone); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		location := autodns.findLocation(target, z)
+		if location != "" {
+			if record, err = autodns.get(location, z); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if location == "" || record == nil {
+			if ns, err = autodns.soaAuthority(z); err != nil {
+				return nil, nil, nil, err
+			}
+			return
+		}
+		name = target
+		if len(record.CNAME) == 0 {
+			final, x, _ := autodns.answer(qtype, name, z, record)
+			if len(final) == 0 {
+				if ns, err = autodns.soaAuthority(z); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+			answers = append(answers, final...)
+			extras = append(extras, x...)
+			return
+		}
 	}
+}
 
+// Name implements the Handler interface.
+func (autodns *Autodns) Name() string { return "autodns" }
+
+// soaAuthority returns the zone SOA for the authority section of negative
+// answers, its TTL capped at the SOA minimum (RFC 2308).
+func (autodns *Autodns) soaAuthority(z *Zone) ([]dns.RR, error) {
+	record, err := autodns.get(z.Name, z)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		record = new(Record)
+	}
+	soa, _ := autodns.SOA(z.Name, z, record)
+	for _, rr := range soa {
+		if s, ok := rr.(*dns.SOA); ok && s.Minttl < s.Hdr.Ttl {
+			s.Hdr.Ttl = s.Minttl
+		}
+	}
+	return soa, nil
+}
+
+// negativeResponse writes NXDOMAIN (rcode NameError) or NODATA (rcode Success)
+// with the zone SOA in the authority section. Without the SOA it answers
+// SERVFAIL instead, as resolvers would cache the negative answer.
+func (autodns *Autodns) negativeResponse(state request.Request, z *Zone, rcode int) (int, error) {
+	soa, err := autodns.soaAuthority(z)
+	if err != nil {
+		return autodns.errorResponse(state, z.Name, dns.RcodeServerFailure, edeNotReady, err)
+	}
 	m := new(dns.Msg)
-	m.SetReply(r)
+	m.SetRcode(state.Req, rcode)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, false, true
-
-	m.Answer = append(m.Answer, answers...)
-	m.Extra = append(m.Extra, extras...)
+	m.Ns = soa
 
 	state.SizeAndDo(m)
 	m = state.Scrub(m)
-	_ = w.WriteMsg(m)
+	_ = state.W.WriteMsg(m)
 	return dns.RcodeSuccess, nil
 }
 
-// Name implements the Handler interface.
-func (autodns *Autodns) Name() string { return "autodns" }
+// extendedError is the RFC 8914 Extended DNS Error attached to an error
+// response. The text is shown to clients, so it never names networks,
+// deny entries or backend details.
+type extendedError struct {
+	code uint16
+	text string
+}
 
-func (autodns *Autodns) errorResponse(state request.Request, zone string, rcode int, err error) (int, error) {
+var (
+	edeNotAllowed   = &extendedError{dns.ExtendedErrorCodeProhibited, "client network not allowed"}
+	edeDenied       = &extendedError{dns.ExtendedErrorCodeProhibited, "name denied by policy"}
+	edeNotOwner     = &extendedError{dns.ExtendedErrorCodeProhibited, "client does not own this name"}
+	edeNotReady     = &extendedError{dns.ExtendedErrorCodeNotReady, "zone data unavailable"}
+	edeNotSupported = &extendedError{dns.ExtendedErrorCodeNotSupported, "query type not supported"}
+)
+
+// errorResponse writes an rcode-only reply. ede, if set, is attached as an
+// EDNS0 option when the query carried OPT.
+func (autodns *Autodns) errorResponse(state request.Request, zone string, rcode int, ede *extendedError, err error) (int, error) {
 	m := new(dns.Msg)
 	m.SetRcode(state.Req, rcode)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, false, true
 
 	state.SizeAndDo(m)
+	if opt := m.IsEdns0(); opt != nil && ede != nil {
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: ede.code, ExtraText: ede.text})
+	}
 	_ = state.W.WriteMsg(m)
 	// Return success as the rcode to signal we have written to the client.
 	return dns.RcodeSuccess, err
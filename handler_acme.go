@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/coredns/coredns/request"
@@ -59,6 +60,9 @@ func parseAcmeDelQuery(qname, zone string) (digest, hostLabel string, ok bool) {
 		return "", "", false
 	}
 	rest := qname[len(acmeDelPrefix):]
+	if strings.EqualFold(rest, zone) {
+		return "", "", true
+	}
 	zoneSuffix := "." + zone
 	if len(rest) < len(zoneSuffix) || !strings.EqualFold(rest[len(rest)-len(zoneSuffix):], zoneSuffix) {
 		return "", "", false
@@ -87,9 +91,9 @@ func acmeDelLabelLooksLikeDigest(label string) bool {
 
 func acmeRedisField(hostLabel string) string {
 	if hostLabel == "" {
-		return "_acme-challenge"
+		return acmeChallengeField
 	}
-	return "_acme-challenge." + hostLabel
+	return acmeChallengeField + "." + hostLabel
 }
 
 func acmePublicName(zone, hostLabel string) string {
@@ -99,7 +103,7 @@ func acmePublicName(zone, hostLabel string) string {
 	return "_acme-challenge." + hostLabel + "." + zone
 }
 
-func appendAcmeTXT(txts []TXT_Record, digest string, ttl uint32, rotate int) []TXT_Record {
+func appendAcmeTXT(txts []TXT_Record, digest string, ttl uint32, rotate int, published int64) []TXT_Record {
 	if rotate <= 0 {
 		rotate = defaultAcmeRotate
 	}
@@ -109,7 +113,7 @@ func appendAcmeTXT(txts []TXT_Record, digest string, ttl uint32, rotate int) []T
 			out = append(out, t)
 		}
 	}
-	out = append(out, TXT_Record{Text: digest, Ttl: ttl})
+	out = append(out, TXT_Record{Text: digest, Ttl: ttl, Published: published})
 	if len(out) > rotate {
 		out = out[len(out)-rotate:]
 	}
@@ -172,7 +176,8 @@ func (autodns *Autodns) AddAcmeTXTRecord(zone string, field string, digest strin
 	if err != nil {
 		return err
 	}
-	record.TXT = appendAcmeTXT(record.TXT, digest, autodns.acmeRrTtl(), autodns.acmeRotate())
+	now := time.Now()
+	record.TXT = appendAcmeTXT(autodns.dropExpiredAcme(record.TXT, now), digest, autodns.acmeRrTtl(), autodns.acmeRotate(), now.Unix())
 	return autodns.writeRecordField(zone, field, record)
 }
 
@@ -189,65 +194,86 @@ func (autodns *Autodns) RemoveAcmeTXTDigest(zone string, field string, digest st
 }
 
 func (autodns *Autodns) DeleteAcmeTXTRecord(zone string, field string) error {
-	conn := autodns.Pool.Get()
-	if conn == nil {
-		return errors.New("error connecting to redis")
-	}
-	defer conn.Close()
-
-	_, err := conn.Do("HDEL", autodns.keyPrefix+zone+autodns.keySuffix, field)
-	if err != nil {
+	if err := autodns.zoneWrite(zone, field, ""); err != nil {
 		return err
 	}
 	logger.Info(`Deleted ACME record from redis for `, field)
 	return nil
 }
 
-func (autodns *Autodns) handleAcmeRegistration(qname, zone, clientIP string, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
-	if !IPBelongsToRegisterNetworks(net.ParseIP(clientIP), autodns.acmeNetworks()) {
-		logger.Warning(`ACME registration request for `, qname, ` from `, clientIP, ` not in acme networks`)
-		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil)
-	}
+var errAcmeDenied = errors.New("acme publishing denied")
 
-	digest, hostLabel, ok := parseAcmeRegQuery(qname, zone)
-	if !ok {
-		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil)
-	}
+// publishAcmeDigest applies the acme.deny policy and stores the digest for
+// _acme-challenge.<hostLabel>.<zone>. source identifies the client in logs.
+func (autodns *Autodns) publishAcmeDigest(zone, hostLabel, digest, source string) error {
 	if hostLabel != "" && !isAcmeHostLabel(hostLabel) {
-		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil)
+		return errAcmeDenied
 	}
 	if autodns.acmeHostBelongsToDeny(hostLabel) {
-		logger.Warning(`ACME registration for `, qname, ` from `, clientIP, ` denied because of acme.deny setting`)
-		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil)
+		logger.Warning(`ACME registration for `, acmePublicName(zone, hostLabel), ` from `, source, ` denied because of acme.deny setting`)
+		autodns.stats.acmeDenied.Add(1)
+		return errAcmeDenied
 	}
 
 	field := acmeRedisField(hostLabel)
-	logger.Info(`ACME registration for `, acmePublicName(zone, hostLabel), ` digest from `, clientIP)
+	logger.Info(`ACME registration for `, acmePublicName(zone, hostLabel), ` digest from `, source)
 	if err := autodns.AddAcmeTXTRecord(zone, field, digest); err != nil {
 		logger.Error(`Error adding ACME TXT record for `, field, ` error: `, err)
-		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, err)
+		return err
+	}
+	autodns.stats.acmePublished.Add(1)
+	return nil
+}
+
+func (autodns *Autodns) handleAcmeRegistration(qname, zone, clientIP string, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
+	if !autodns.acmeAllowed(net.ParseIP(clientIP)) {
+		logger.Warning(`ACME registration request for `, qname, ` from `, clientIP, ` not in acme networks`)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotAllowed, nil)
+	}
+
+	digest, hostLabel, ok := parseAcmeRegQuery(qname, zone)
+	if !ok {
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil, nil)
+	}
+	if !autodns.acmeOwnerAllowed(zone, hostLabel, clientIP) {
+		logger.Warning(`ACME registration for `, qname, ` from `, clientIP, ` denied because of acme.require_owner setting`)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotOwner, nil)
+	}
+	if err := autodns.publishAcmeDigest(zone, hostLabel, digest, clientIP); err != nil {
+		if errors.Is(err, errAcmeDenied) {
+			return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeDenied, nil)
+		}
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, edeNotReady, err)
 	}
 
 	reply := acmePublicName(zone, hostLabel)
 	if _, err := autodns.TXTReply(qname, []string{strings.TrimSuffix(reply, ".")}, r, state, w); err != nil {
 		logger.Error(`Error sending ACME TXT reply for `, qname, ` error: `, err)
-		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, err)
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, nil, err)
 	}
 	return dns.RcodeSuccess, nil
 }
 
 func (autodns *Autodns) handleAcmeDeletion(qname, zone, clientIP string, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
-	if !IPBelongsToRegisterNetworks(net.ParseIP(clientIP), autodns.acmeNetworks()) {
+	if !autodns.acmeAllowed(net.ParseIP(clientIP)) {
 		logger.Warning(`ACME deletion request for `, qname, ` from `, clientIP, ` not in acme networks`)
-		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotAllowed, nil)
 	}
 
 	digest, hostLabel, ok := parseAcmeDelQuery(qname, zone)
 	if !ok {
-		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil, nil)
 	}
 	if hostLabel != "" && !isAcmeHostLabel(hostLabel) {
-		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil, nil)
+	}
+	if !autodns.acmeOwnerAllowed(zone, hostLabel, clientIP) {
+		logger.Warning(`ACME deletion for `, qname, ` from `, clientIP, ` denied because of acme.require_owner setting`)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotOwner, nil)
 	}
 
 	field := acmeRedisField(hostLabel)
@@ -261,19 +287,52 @@ func (autodns *Autodns) handleAcmeDeletion(qname, zone, clientIP string, r *dns.
 	}
 	if err != nil {
 		logger.Error(`Error deleting ACME TXT record for `, field, ` error: `, err)
-		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, err)
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, edeNotReady, err)
 	}
+	autodns.stats.acmeDeleted.Add(1)
 
 	reply := "deleted"
 	if hostLabel != "" {
 		reply = strings.TrimSuffix(acmePublicName(zone, hostLabel), ".")
 	}
 	if _, err := autodns.TXTReply(qname, []string{reply}, r, state, w); err != nil {
-		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, err)
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, nil, err)
 	}
 	return dns.RcodeSuccess, nil
 }
 
+// acmeOwnerAllowed implements acme.require_owner: a host's challenge may only be
+// changed from the address registered for that host, the apex (and with it the
+// wildcard) only from acme.admin_network. Admin networks may change any name.
+func (autodns *Autodns) acmeOwnerAllowed(zone, hostLabel, clientIP string) bool {
+	if !autodns.AcmeRequireOwner {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if IPBelongsToRegisterNetworks(ip, autodns.AcmeAdminNetworks) {
+		return true
+	}
+	if hostLabel == "" || ip == nil {
+		return false
+	}
+	record, err := autodns.readRecordField(zone, hostLabel)
+	if err != nil {
+		logger.Error(`Error reading owner record `, hostLabel, ` error: `, err)
+		return false
+	}
+	for _, a := range record.A {
+		if a.Ip.Equal(ip) {
+			return true
+		}
+	}
+	for _, aaaa := range record.AAAA {
+		if aaaa.Ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func isAcmeHostLabel(label string) bool {
 	if label == "" {
 		return false
@@ -290,3 +349,123 @@ func isAcmeHostLabel(label string) bool {
 	}
 	return true
 }
+
+const (
+	persistRegPrefix  = "_persist-reg."
+	persistWildPrefix = "_persist-wild."
+	persistDelPrefix  = "_persist-del."
+	persistField      = "_validation-persist"
+)
+
+// persistIssuer is one acme.persist entry: the CA allowed to validate through
+// a dns-persist-01 record and the ACME account bound to it.
+type persistIssuer struct {
+	Domain     string
+	AccountURI string
+}
+
+// parsePersistQuery parses <prefix>[<host>.]<zone>; an empty host is the apex.
+func parsePersistQuery(prefix, qname, zone string) (hostLabel string, ok bool) {
+	if len(qname) < len(prefix) || !strings.EqualFold(qname[:len(prefix)], prefix) {
+		return "", false
+	}
+	rest := qname[len(prefix):]
+	if strings.EqualFold(rest, zone) {
+		return "", true
+	}
+	zoneSuffix := "." + zone
+	if len(rest) <= len(zoneSuffix) || !strings.EqualFold(rest[len(rest)-len(zoneSuffix):], zoneSuffix) {
+		return "", false
+	}
+	hostLabel = strings.ToLower(rest[:len(rest)-len(zoneSuffix)])
+	if !isAcmeHostLabel(hostLabel) {
+		return "", false
+	}
+	return hostLabel, true
+}
+
+func persistRedisField(hostLabel string) string {
+	if hostLabel == "" {
+		return persistField
+	}
+	return persistField + "." + hostLabel
+}
+
+func persistPublicName(zone, hostLabel string) string {
+	if hostLabel == "" {
+		return persistField + "." + zone
+	}
+	return persistField + "." + hostLabel + "." + zone
+}
+
+// renderPersistValue renders the structured dns-persist-01 TXT value,
+// e.g. "letsencrypt.org; accounturi=https://...; policy=wildcard".
+func renderPersistValue(issuer persistIssuer, wildcard bool) string {
+	parts := []string{issuer.Domain, "accounturi=" + issuer.AccountURI}
+	if wildcard {
+		parts = append(parts, "policy=wildcard")
+	}
+	return strings.Join(parts, "; ")
+}
+
+// SetPersistRecord replaces the _validation-persist TXT set of a name with one
+// value per acme.persist issuer.
+func (autodns *Autodns) SetPersistRecord(zone, hostLabel string, wildcard bool) error {
+	record := &Record{}
+	for _, issuer := range autodns.AcmePersist {
+		record.TXT = append(record.TXT, TXT_Record{Text: renderPersistValue(issuer, wildcard)})
+	}
+	return autodns.writeRecordField(zone, persistRedisField(hostLabel), record)
+}
+
+func (autodns *Autodns) handlePersist(qname, zone, clientIP string, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
+	if len(autodns.AcmePersist) == 0 {
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil, nil)
+	}
+	if !autodns.acmeAllowed(net.ParseIP(clientIP)) {
+		logger.Warning(`Persistent validation request for `, qname, ` from `, clientIP, ` not in acme networks`)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotAllowed, nil)
+	}
+
+	var prefix string
+	for _, p := range []string{persistRegPrefix, persistWildPrefix, persistDelPrefix} {
+		if len(qname) >= len(p) && strings.EqualFold(qname[:len(p)], p) {
+			prefix = p
+		}
+	}
+	hostLabel, ok := parsePersistQuery(prefix, qname, zone)
+	if !ok {
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil, nil)
+	}
+	if autodns.acmeHostBelongsToDeny(hostLabel) {
+		logger.Warning(`Persistent validation for `, persistPublicName(zone, hostLabel), ` from `, clientIP, ` denied because of acme.deny setting`)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeDenied, nil)
+	}
+	if !autodns.acmeOwnerAllowed(zone, hostLabel, clientIP) {
+		logger.Warning(`Persistent validation for `, persistPublicName(zone, hostLabel), ` from `, clientIP, ` denied because of acme.require_owner setting`)
+		autodns.stats.acmeDenied.Add(1)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotOwner, nil)
+	}
+
+	var err error
+	reply := strings.TrimSuffix(persistPublicName(zone, hostLabel), ".")
+	if prefix == persistDelPrefix {
+		logger.Info(`Persistent validation deletion for `, persistPublicName(zone, hostLabel), ` from `, clientIP)
+		err = autodns.DeleteAcmeTXTRecord(zone, persistRedisField(hostLabel))
+		reply = "deleted"
+	} else {
+		logger.Info(`Persistent validation registration for `, persistPublicName(zone, hostLabel), ` from `, clientIP)
+		err = autodns.SetPersistRecord(zone, hostLabel, prefix == persistWildPrefix)
+	}
+	if err != nil {
+		logger.Error(`Error updating persistent validation record for `, qname, ` error: `, err)
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, edeNotReady, err)
+	}
+
+	if _, err := autodns.TXTReply(qname, []string{reply}, r, state, w); err != nil {
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, nil, err)
+	}
+	return dns.RcodeSuccess, nil
+}
@@ -1,11 +1,13 @@
 package autodns
 
 import (
+	"fmt"
 	"net"
 	"strings"
 	"testing"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin/test"
 	"github.com/miekg/dns"
 )
@@ -139,15 +141,15 @@ func TestAcmeRotateOverflow(t *testing.T) {
 
 func TestAppendAcmeTXT(t *testing.T) {
 	ttl := uint32(120)
-	txts := appendAcmeTXT(nil, testAcmeDigest, ttl, 5)
+	txts := appendAcmeTXT(nil, testAcmeDigest, ttl, 5, 0)
 	if len(txts) != 1 || txts[0].Text != testAcmeDigest {
 		t.Fatalf("first append = %+v", txts)
 	}
-	txts = appendAcmeTXT(txts, testAcmeDigest2, ttl, 5)
+	txts = appendAcmeTXT(txts, testAcmeDigest2, ttl, 5, 0)
 	if len(txts) != 2 {
 		t.Fatalf("len = %d, want 2", len(txts))
 	}
-	txts = appendAcmeTXT(txts, testAcmeDigest, ttl, 5)
+	txts = appendAcmeTXT(txts, testAcmeDigest, ttl, 5, 0)
 	if len(txts) != 2 || txts[1].Text != testAcmeDigest {
 		t.Fatalf("republish should move digest to end without duplicate, got %+v", txts)
 	}
@@ -338,3 +340,94 @@ func mustParseCIDRs(t *testing.T, cidrs ...string) []net.IPNet {
 	}
 	return nets
 }
+
+func TestParsePersistQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		qname    string
+		wantHost string
+		wantOK   bool
+	}{
+		{name: "apex", prefix: persistRegPrefix, qname: "_persist-reg.example.net.", wantHost: "", wantOK: true},
+		{name: "host", prefix: persistWildPrefix, qname: "_persist-wild.Host1.example.net.", wantHost: "host1", wantOK: true},
+		{name: "invalid host", prefix: persistDelPrefix, qname: "_persist-del.ho*st.example.net.", wantOK: false},
+		{name: "other zone", prefix: persistRegPrefix, qname: "_persist-reg.host1.example.org.", wantOK: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			host, ok := parsePersistQuery(tc.prefix, tc.qname, exampleZone)
+			if ok != tc.wantOK || host != tc.wantHost {
+				t.Fatalf("got (%q, %v), want (%q, %v)", host, ok, tc.wantHost, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestServeDNSPersist(t *testing.T) {
+	a, mr := acmeAutodns(t)
+	a.AcmePersist = []persistIssuer{{Domain: "letsencrypt.org", AccountURI: "https://acme-v02.api.letsencrypt.org/acme/acct/123"}}
+	a.AcmeDeny = []string{"www"}
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	resp := serveDNS(t, a, "100.64.0.10", "_persist-wild.host1."+exampleZone, dns.TypeTXT)
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("register rcode = %d", resp.Rcode)
+	}
+	if got := strings.Join(resp.Answer[0].(*dns.TXT).Txt, ""); got != "_validation-persist.host1.example.net" {
+		t.Fatalf("reply = %q", got)
+	}
+
+	public := serveDNS(t, a, "8.8.8.8", "_validation-persist.host1."+exampleZone, dns.TypeTXT)
+	tc := test.Case{
+		Qname:  "_validation-persist.host1." + exampleZone,
+		Qtype:  dns.TypeTXT,
+		Answer: []dns.RR{test.TXT(`_validation-persist.host1.example.net. 300 IN TXT "letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/123; policy=wildcard"`)},
+	}
+	if err := test.SortAndCheck(public, tc); err != nil {
+		t.Error(err)
+	}
+
+	if resp := serveDNS(t, a, "100.64.0.10", "_persist-reg.www."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("denied host rcode = %d, want NXDOMAIN", resp.Rcode)
+	}
+	if resp := serveDNS(t, a, "8.8.8.8", "_persist-del.host1."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("outside acme networks rcode = %d, want NXDOMAIN", resp.Rcode)
+	}
+	if resp := serveDNS(t, a, "100.64.0.10", "_persist-del.host1."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("delete rcode = %d", resp.Rcode)
+	}
+	if stored := mr.HGet(zoneKey, "_validation-persist.host1"); stored != "" {
+		t.Fatalf("redis = %q, want deleted", stored)
+	}
+}
+
+func TestServeDNSPersistDisabled(t *testing.T) {
+	a, _ := acmeAutodns(t)
+	if resp := serveDNS(t, a, "100.64.0.10", "_persist-reg."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode = %d, want NXDOMAIN without acme.persist", resp.Rcode)
+	}
+}
+
+func TestAcmePersistSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.persist LetsEncrypt.org %s
+	}`, mr.Addr(), testAccountURI))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if len(a.AcmePersist) != 1 || a.AcmePersist[0].Domain != "letsencrypt.org" || a.AcmePersist[0].AccountURI != testAccountURI {
+		t.Fatalf("AcmePersist = %+v", a.AcmePersist)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		acme.persist letsencrypt.org
+	}`, mr.Addr()))
+	if _, err := redisSetup(c); err == nil {
+		t.Fatal("expected error without account uri")
+	}
+}
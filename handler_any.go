@@ -0,0 +1,44 @@
+package autodns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	anyResponseHinfo = "hinfo"
+	anyResponseRRset = "rrset"
+)
+
+// anyTypes is the order RRsets are tried in for ANY queries.
+var anyTypes = []string{"SOA", "NS", "A", "AAAA", "CNAME", "MX", "SRV", "TXT", "CAA", "DS"}
+
+// anyAnswer answers an ANY query following RFC 8482: clients in any.full get
+// every RRset at the name, everyone else a synthesized HINFO or, with
+// any.response rrset, the first RRset found.
+func (autodns *Autodns) anyAnswer(name, clientIP string, z *Zone, record *Record) (answers, extras []dns.RR) {
+	if record == nil {
+		return nil, nil
+	}
+	full := IPBelongsToRegisterNetworks(net.ParseIP(clientIP), autodns.AnyFullNetworks)
+	if !full && autodns.AnyResponse != anyResponseRRset {
+		r := new(dns.HINFO)
+		r.Hdr = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeHINFO,
+			Class: dns.ClassINET, Ttl: autodns.minTtl(0)}
+		r.Cpu = "RFC8482"
+		return []dns.RR{r}, nil
+	}
+	for _, qtype := range anyTypes {
+		as, xs, _ := autodns.answer(qtype, name, z, record)
+		if len(as) == 0 {
+			continue
+		}
+		answers = append(answers, as...)
+		extras = append(extras, xs...)
+		if !full {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,86 @@
+package autodns
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSAny(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, "host3", `{"a":[{"ttl":300,"ip":"5.5.5.7"}],"txt":[{"ttl":300,"text":"hello"}]}`)
+	a.AnyFullNetworks = mustParseCIDRs(t, "10.0.0.0/8")
+
+	t.Run("minimal hinfo", func(t *testing.T) {
+		resp := serveDNS(t, a, "192.0.2.1", "host3.example.net.", dns.TypeANY)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			t.Fatalf("rcode = %d, answer = %v", resp.Rcode, resp.Answer)
+		}
+		hinfo, ok := resp.Answer[0].(*dns.HINFO)
+		if !ok || hinfo.Cpu != "RFC8482" || hinfo.Os != "" {
+			t.Fatalf("answer = %v, want RFC8482 HINFO", resp.Answer[0])
+		}
+	})
+
+	t.Run("minimal rrset", func(t *testing.T) {
+		a.AnyResponse = anyResponseRRset
+		defer func() { a.AnyResponse = "" }()
+		resp := serveDNS(t, a, "192.0.2.1", "host3.example.net.", dns.TypeANY)
+		tc := test.Case{
+			Qname: "host3.example.net.", Qtype: dns.TypeANY,
+			Answer: []dns.RR{test.A("host3.example.net. 300 IN A 5.5.5.7")},
+		}
+		if err := test.SortAndCheck(resp, tc); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("full for trusted networks", func(t *testing.T) {
+		resp := serveDNS(t, a, "10.1.2.3", "host3.example.net.", dns.TypeANY)
+		tc := test.Case{
+			Qname: "host3.example.net.", Qtype: dns.TypeANY,
+			Answer: []dns.RR{
+				test.A("host3.example.net. 300 IN A 5.5.5.7"),
+				test.TXT(`host3.example.net. 300 IN TXT "hello"`),
+			},
+		}
+		if err := test.SortAndCheck(resp, tc); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("missing name", func(t *testing.T) {
+		resp := serveDNS(t, a, "10.1.2.3", "_tcp.host1.example.net.", dns.TypeANY)
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+			t.Fatalf("rcode = %d, answer = %v, ns = %v, want NODATA", resp.Rcode, resp.Answer, resp.Ns)
+		}
+	})
+}
+
+func TestAnySetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		any.response rrset
+		any.full 10.0.0.0/8 fd00::/8
+	}`, mr.Addr()))
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if a.AnyResponse != anyResponseRRset || len(a.AnyFullNetworks) != 2 {
+		t.Fatalf("any.response = %q, any.full = %v", a.AnyResponse, a.AnyFullNetworks)
+	}
+
+	c = caddy.NewTestController("dns", fmt.Sprintf(`autodns {
+		address %s
+		any.response everything
+	}`, mr.Addr()))
+	if _, err := redisSetup(c); err == nil {
+		t.Fatal("expected error for unknown any.response")
+	}
+}
@@ -0,0 +1,103 @@
+package autodns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const chaosDomain = "autodns."
+
+// autodnsStats holds the counters reported by stats.autodns.
+type autodnsStats struct {
+	registrations      atomic.Uint64
+	registrationDenied atomic.Uint64
+	acmePublished      atomic.Uint64
+	acmeDeleted        atomic.Uint64
+	acmeDenied         atomic.Uint64
+	cacheHits          atomic.Uint64
+	cacheMisses        atomic.Uint64
+}
+
+func isChaosQuery(state request.Request) bool {
+	return state.QClass() == dns.ClassCHAOS && dns.IsSubDomain(chaosDomain, state.Name())
+}
+
+func (autodns *Autodns) handleChaos(state request.Request, clientIP string) (int, error) {
+	if !IPBelongsToRegisterNetworks(net.ParseIP(clientIP), autodns.ChaosNetworks) {
+		logger.Warning(`CHAOS request for `, state.Name(), ` from `, clientIP, ` not in chaos networks`)
+		return autodns.errorResponse(state, chaosDomain, dns.RcodeRefused, edeNotAllowed, nil)
+	}
+	if state.QType() != dns.TypeTXT {
+		return autodns.errorResponse(state, chaosDomain, dns.RcodeNotImplemented, edeNotSupported, nil)
+	}
+
+	var reply []string
+	switch state.Name() {
+	case "zones." + chaosDomain:
+		reply = autodns.chaosZones()
+	case "stats." + chaosDomain:
+		reply = autodns.chaosStats()
+	case "redis." + chaosDomain:
+		reply = autodns.chaosRedis()
+	default:
+		return autodns.errorResponse(state, chaosDomain, dns.RcodeNameError, nil, nil)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(state.Req)
+	m.Authoritative, m.RecursionAvailable = true, false
+	for _, line := range reply {
+		r := new(dns.TXT)
+		r.Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+		r.Txt = split255(line)
+		m.Answer = append(m.Answer, r)
+	}
+	state.SizeAndDo(m)
+	m = state.Scrub(m)
+	_ = state.W.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
+
+func (autodns *Autodns) chaosZones() []string {
+	zones := autodns.zones()
+	if len(zones) == 0 {
+		return []string{"zones="}
+	}
+	return []string{"zones=" + strings.Join(zones, ",")}
+}
+
+func (autodns *Autodns) chaosStats() []string {
+	return []string{
+		"last_zone_update=" + autodns.lastZoneUpdate().UTC().Format("2006-01-02T15:04:05Z"),
+		fmt.Sprintf("registrations=%d", autodns.stats.registrations.Load()),
+		fmt.Sprintf("registrations_denied=%d", autodns.stats.registrationDenied.Load()),
+		fmt.Sprintf("acme_published=%d", autodns.stats.acmePublished.Load()),
+		fmt.Sprintf("acme_deleted=%d", autodns.stats.acmeDeleted.Load()),
+		fmt.Sprintf("acme_denied=%d", autodns.stats.acmeDenied.Load()),
+		fmt.Sprintf("zone_cache_hits=%d", autodns.stats.cacheHits.Load()),
+		fmt.Sprintf("zone_cache_misses=%d", autodns.stats.cacheMisses.Load()),
+	}
+}
+
+func (autodns *Autodns) chaosRedis() []string {
+	status := "ok"
+	conn := autodns.Pool.Get()
+	if _, err := conn.Do("PING"); err != nil {
+		status = "down"
+	}
+	conn.Close()
+
+	stats := autodns.Pool.Stats()
+	return []string{
+		"status=" + status,
+		fmt.Sprintf("pool_active=%d", stats.ActiveCount),
+		fmt.Sprintf("pool_idle=%d", stats.IdleCount),
+		fmt.Sprintf("pool_wait_count=%d", stats.WaitCount),
+		fmt.Sprintf("pool_wait_duration=%s", stats.WaitDuration),
+	}
+}
@@ -0,0 +1,118 @@
+package autodns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func serveChaos(t *testing.T, a *Autodns, ip string, qname string) (int, *dns.Msg) {
+	t.Helper()
+
+	rec := newRecorderWithIP(t, ip)
+	m := new(dns.Msg)
+	m.SetQuestion(qname, dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+
+	rcode, err := a.ServeDNS(context.Background(), rec, m)
+	if err != nil {
+		t.Fatalf("ServeDNS error: %v", err)
+	}
+	return rcode, rec.Msg
+}
+
+func chaosText(resp *dns.Msg) string {
+	var lines []string
+	for _, rr := range resp.Answer {
+		lines = append(lines, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestServeDNSChaos(t *testing.T) {
+	a, _ := registrationAutodns(t)
+	a.ChaosNetworks = mustParseCIDRs(t, "127.0.0.0/8")
+
+	if resp := serveDNS(t, a, "100.64.0.10", "_reg.host9."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("register rcode = %d", resp.Rcode)
+	}
+	serveDNS(t, a, "8.8.8.8", "_reg.host9."+exampleZone, dns.TypeTXT)
+
+	t.Run("zones", func(t *testing.T) {
+		_, resp := serveChaos(t, a, "127.0.0.1", "zones.autodns.")
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %d", resp.Rcode)
+		}
+		if got := chaosText(resp); got != "zones="+exampleZone {
+			t.Fatalf("zones = %q", got)
+		}
+		if resp.Answer[0].Header().Class != dns.ClassCHAOS {
+			t.Fatalf("class = %d, want CHAOS", resp.Answer[0].Header().Class)
+		}
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		_, resp := serveChaos(t, a, "127.0.0.1", "stats.autodns.")
+		got := chaosText(resp)
+		for _, want := range []string{"last_zone_update=", "registrations=1", "registrations_denied=1", "acme_published=0"} {
+			if !strings.Contains(got, want) {
+				t.Fatalf("stats = %q, missing %q", got, want)
+			}
+		}
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		_, resp := serveChaos(t, a, "127.0.0.1", "redis.autodns.")
+		got := chaosText(resp)
+		if !strings.Contains(got, "status=ok") || !strings.Contains(got, "pool_idle=") {
+			t.Fatalf("redis = %q", got)
+		}
+	})
+
+	t.Run("unknown name", func(t *testing.T) {
+		_, resp := serveChaos(t, a, "127.0.0.1", "nothing.autodns.")
+		if resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("rcode = %d, want NXDOMAIN", resp.Rcode)
+		}
+	})
+
+	t.Run("outside chaos.network", func(t *testing.T) {
+		_, resp := serveChaos(t, a, "8.8.8.8", "stats.autodns.")
+		if resp.Rcode != dns.RcodeRefused {
+			t.Fatalf("rcode = %d, want REFUSED", resp.Rcode)
+		}
+	})
+}
+
+func TestServeDNSChaosDisabled(t *testing.T) {
+	a, _ := prepareServeDNS(t)
+	a.Next = test.NextHandler(dns.RcodeRefused, nil)
+
+	rcode, _ := serveChaos(t, a, "127.0.0.1", "zones.autodns.")
+	if rcode != dns.RcodeRefused {
+		t.Fatalf("rcode = %d, want REFUSED from next handler", rcode)
+	}
+}
+
+func TestChaosNetworkSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	corefile := fmt.Sprintf(`autodns {
+		address %s
+		chaos.network 127.0.0.1/32
+	}`, mr.Addr())
+
+	c := caddy.NewTestController("dns", corefile)
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if len(a.ChaosNetworks) != 1 {
+		t.Fatalf("ChaosNetworks = %v, want 1 entry", a.ChaosNetworks)
+	}
+}
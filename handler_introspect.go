@@ -0,0 +1,157 @@
+package autodns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	whoamiLabel  = "_whoami"
+	statusPrefix = "_status."
+)
+
+func (autodns *Autodns) statusNetworks() []net.IPNet {
+	if len(autodns.StatusNetworks) > 0 {
+		return autodns.StatusNetworks
+	}
+	return autodns.RegisterNetworks
+}
+
+func matchingNetworks(ip net.IP, networks []net.IPNet) []string {
+	var matched []string
+	for _, network := range networks {
+		if network.Contains(ip) {
+			matched = append(matched, network.String())
+		}
+	}
+	return matched
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// recordTypes lists the RRset types present in a stored record.
+func recordTypes(record *Record) []string {
+	if record == nil {
+		return nil
+	}
+	var types []string
+	if record.SOA.Ns != "" {
+		types = append(types, "SOA")
+	}
+	if len(record.NS) > 0 {
+		types = append(types, "NS")
+	}
+	if len(record.A) > 0 {
+		types = append(types, "A")
+	}
+	if len(record.AAAA) > 0 {
+		types = append(types, "AAAA")
+	}
+	if len(record.CNAME) > 0 {
+		types = append(types, "CNAME")
+	}
+	if len(record.MX) > 0 {
+		types = append(types, "MX")
+	}
+	if len(record.SRV) > 0 {
+		types = append(types, "SRV")
+	}
+	if len(record.TXT) > 0 {
+		types = append(types, "TXT")
+	}
+	if len(record.CAA) > 0 {
+		types = append(types, "CAA")
+	}
+	if len(record.DS) > 0 {
+		types = append(types, "DS")
+	}
+	return types
+}
+
+func isWhoamiQuery(qname, zone string) bool {
+	return qname == whoamiLabel+"."+zone
+}
+
+func parseStatusQuery(qname, zone string) (hostLabel string, ok bool) {
+	if !strings.HasPrefix(qname, statusPrefix) {
+		return "", false
+	}
+	rest := strings.TrimPrefix(qname, statusPrefix)
+	if rest == zone {
+		return "@", true
+	}
+	if !strings.HasSuffix(rest, "."+zone) {
+		return "", false
+	}
+	return strings.TrimSuffix(rest, "."+zone), true
+}
+
+func (autodns *Autodns) handleWhoami(qname, zone, clientIP string, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
+	ip := net.ParseIP(clientIP)
+	registerMatches := matchingNetworks(ip, autodns.RegisterNetworks)
+	acmeMatches := matchingNetworks(ip, autodns.acmeNetworks())
+
+	reply := []string{
+		"ip=" + clientIP,
+		"register.network=" + strings.Join(registerMatches, ","),
+		"acme.network=" + strings.Join(acmeMatches, ","),
+	}
+	if len(autodns.AcmeAdminNetworks) > 0 {
+		reply = append(reply, "acme.admin_network="+strings.Join(matchingNetworks(ip, autodns.AcmeAdminNetworks), ","))
+	}
+	reply = append(reply,
+		"register="+yesNo(len(registerMatches) > 0),
+		"acme="+yesNo(autodns.acmeAllowed(ip)),
+	)
+	if _, err := autodns.TXTReply(qname, reply, r, state, w); err != nil {
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, nil, err)
+	}
+	return dns.RcodeSuccess, nil
+}
+
+func (autodns *Autodns) handleStatus(qname, zone, hostLabel, clientIP string, z *Zone, r *dns.Msg, state *request.Request, w dns.ResponseWriter) (int, error) {
+	if !IPBelongsToRegisterNetworks(net.ParseIP(clientIP), autodns.statusNetworks()) {
+		logger.Warning(`Status request for `, qname, ` from `, clientIP, ` not in status networks`)
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, edeNotAllowed, nil)
+	}
+	if !keyExists(hostLabel, z) {
+		return autodns.errorResponse(*state, zone, dns.RcodeNameError, nil, nil)
+	}
+
+	location := hostLabel
+	if hostLabel == "@" {
+		location = z.Name
+	}
+	record, err := autodns.get(location, z)
+	if err != nil || record == nil {
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, edeNotReady, err)
+	}
+
+	name := zone
+	if hostLabel != "@" {
+		name = hostLabel + "." + zone
+	}
+	reply := []string{
+		"name=" + strings.TrimSuffix(name, "."),
+		"types=" + strings.Join(recordTypes(record), ","),
+	}
+	for _, a := range record.A {
+		reply = append(reply, fmt.Sprintf("a=%s ttl=%d", a.Ip, autodns.minTtl(a.Ttl)))
+	}
+	for _, aaaa := range record.AAAA {
+		reply = append(reply, fmt.Sprintf("aaaa=%s ttl=%d", aaaa.Ip, autodns.minTtl(aaaa.Ttl)))
+	}
+	if _, err := autodns.TXTReply(qname, reply, r, state, w); err != nil {
+		return autodns.errorResponse(*state, zone, dns.RcodeServerFailure, nil, err)
+	}
+	return dns.RcodeSuccess, nil
+}
@@ -0,0 +1,133 @@
+package autodns
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func txtStrings(t *testing.T, resp *dns.Msg) []string {
+	t.Helper()
+	if len(resp.Answer) != 1 {
+		t.Fatalf("answer count = %d, want 1", len(resp.Answer))
+	}
+	txt, ok := resp.Answer[0].(*dns.TXT)
+	if !ok {
+		t.Fatalf("answer is %T, want TXT", resp.Answer[0])
+	}
+	return txt.Txt
+}
+
+func TestServeDNSWhoami(t *testing.T) {
+	a, _ := registrationAutodns(t)
+	a.AcmeNetworks = mustParseCIDRs(t, "100.64.1.0/24")
+
+	t.Run("trusted client", func(t *testing.T) {
+		resp := serveDNS(t, a, "100.64.1.10", "_whoami."+exampleZone, dns.TypeTXT)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %d, want success", resp.Rcode)
+		}
+		got := strings.Join(txtStrings(t, resp), " ")
+		for _, want := range []string{"ip=100.64.1.10", "register.network=100.64.0.0/16", "acme.network=100.64.1.0/24", "register=yes", "acme=yes"} {
+			if !strings.Contains(got, want) {
+				t.Fatalf("whoami = %q, missing %q", got, want)
+			}
+		}
+	})
+
+	t.Run("public client", func(t *testing.T) {
+		resp := serveDNS(t, a, "8.8.8.8", "_whoami."+exampleZone, dns.TypeTXT)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %d, want success", resp.Rcode)
+		}
+		got := strings.Join(txtStrings(t, resp), " ")
+		if !strings.Contains(got, "ip=8.8.8.8") || !strings.Contains(got, "register=no") || !strings.Contains(got, "acme=no") {
+			t.Fatalf("whoami = %q", got)
+		}
+	})
+
+	t.Run("admin client", func(t *testing.T) {
+		a.AcmeAdminNetworks = mustParseCIDRs(t, "192.0.2.0/24")
+		defer func() { a.AcmeAdminNetworks = nil }()
+		resp := serveDNS(t, a, "192.0.2.1", "_whoami."+exampleZone, dns.TypeTXT)
+		got := strings.Join(txtStrings(t, resp), " ")
+		for _, want := range []string{"acme.network= ", "acme.admin_network=192.0.2.0/24", "acme=yes"} {
+			if !strings.Contains(got, want) {
+				t.Fatalf("whoami = %q, missing %q", got, want)
+			}
+		}
+	})
+}
+
+func TestServeDNSStatus(t *testing.T) {
+	a, _ := registrationAutodns(t)
+	if resp := serveDNS(t, a, "100.64.0.10", "_reg.host9."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("register rcode = %d", resp.Rcode)
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		resp := serveDNS(t, a, "100.64.0.20", "_status.host9."+exampleZone, dns.TypeTXT)
+		if resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %d, want success", resp.Rcode)
+		}
+		got := txtStrings(t, resp)
+		want := []string{"name=host9.example.net", "types=A", "a=100.64.0.10 ttl=300"}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Fatalf("status = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("apex", func(t *testing.T) {
+		resp := serveDNS(t, a, "100.64.0.20", "_status."+exampleZone, dns.TypeTXT)
+		got := txtStrings(t, resp)
+		if got[1] != "types=SOA,NS" {
+			t.Fatalf("apex types = %q", got[1])
+		}
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		resp := serveDNS(t, a, "100.64.0.20", "_status.nothere."+exampleZone, dns.TypeTXT)
+		if resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("rcode = %d, want NXDOMAIN", resp.Rcode)
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		resp := serveDNS(t, a, "8.8.8.8", "_status.host9."+exampleZone, dns.TypeTXT)
+		if resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("rcode = %d, want NXDOMAIN", resp.Rcode)
+		}
+	})
+
+	t.Run("status.network overrides", func(t *testing.T) {
+		a.StatusNetworks = mustParseCIDRs(t, "10.0.0.0/8")
+		defer func() { a.StatusNetworks = nil }()
+		if resp := serveDNS(t, a, "100.64.0.20", "_status.host9."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeNameError {
+			t.Fatalf("rcode = %d, want NXDOMAIN outside status.network", resp.Rcode)
+		}
+		if resp := serveDNS(t, a, "10.1.2.3", "_status.host9."+exampleZone, dns.TypeTXT); resp.Rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %d, want success inside status.network", resp.Rcode)
+		}
+	})
+}
+
+func TestStatusNetworkSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	corefile := fmt.Sprintf(`autodns {
+		address %s
+		status.network 10.0.0.0/8 fd00::/8
+	}`, mr.Addr())
+
+	c := caddy.NewTestController("dns", corefile)
+	a, err := redisSetup(c)
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	if len(a.StatusNetworks) != 2 {
+		t.Fatalf("StatusNetworks = %v, want 2 entries", a.StatusNetworks)
+	}
+}
@@ -2,12 +2,14 @@ package autodns
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"strings"
 	"testing"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
@@ -47,7 +49,7 @@ func TestServeDNSLookups(t *testing.T) {
 		},
 		{
 			Qname: "subdel.example.net.", Qtype: dns.TypeNS,
-			Answer: []dns.RR{
+			Ns: []dns.RR{
 				test.NS("subdel.example.net. 300 IN NS ns1.subdel.example.net."),
 				test.NS("subdel.example.net. 300 IN NS ns2.subdel.example.net."),
 			},
@@ -63,7 +65,7 @@ func TestServeDNSLookups(t *testing.T) {
 		},
 		{
 			Qname: "host2.example.net.", Qtype: dns.TypeCAA,
-			Answer: []dns.RR{test.CAA("host2.example.net. 0 IN CAA 0 issue \"letsencrypt.org\"")},
+			Answer: []dns.RR{test.CAA("host2.example.net. 300 IN CAA 0 issue \"letsencrypt.org\"")},
 		},
 		{
 			Qname: "example.net.", Qtype: dns.TypeSOA,
@@ -88,7 +90,7 @@ func TestServeDNSNXDOMAIN(t *testing.T) {
 	a, mr := newTestAutodns(t)
 	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
 	mr.HSet(zoneKey, "host1", `{"a":[{"ttl":300,"ip":"5.5.5.5"}]}`)
-	a.Zones = []string{exampleZone}
+	a.setZones([]string{exampleZone})
 
 	resp := serveDNS(t, a, "127.0.0.1", "nonexistent.example.net.", dns.TypeA)
 	if resp.Rcode != dns.RcodeNameError {
@@ -126,7 +128,7 @@ func seedRegistrationZone(t *testing.T, mr *miniredis.Miniredis, a *Autodns) {
 
 	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
 	mr.HSet(zoneKey, "@", `{"soa":{"ttl":300,"minttl":100,"mbox":"hostmaster.example.net.","ns":"ns1.example.net.","refresh":44,"retry":55,"expire":66},"ns":[{"ttl":300,"host":"ns1.example.net."},{"ttl":300,"host":"ns2.example.net."}]}`)
-	a.Zones = []string{exampleZone}
+	a.setZones([]string{exampleZone})
 }
 
 func registrationAutodns(t *testing.T) (*Autodns, *miniredis.Miniredis) {
@@ -368,3 +370,282 @@ func TestServeDNSRegistrationIPv6(t *testing.T) {
 		t.Fatalf("IPv6 registration must not create A record, got %q", stored)
 	}
 }
+
+func serveDNSEdns(t *testing.T, a *Autodns, ip string, qname string, qtype uint16) *dns.Msg {
+	t.Helper()
+
+	rec := newRecorderWithIP(t, ip)
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), qtype)
+	m.SetEdns0(4096, false)
+	if _, err := a.ServeDNS(context.Background(), rec, m); err != nil {
+		t.Fatalf("ServeDNS error: %v", err)
+	}
+	return rec.Msg
+}
+
+// serveDNSFailing runs a query that must fail with an error, which CoreDNS
+// hands to the errors plugin, and returns the reply written before.
+func serveDNSFailing(t *testing.T, a *Autodns, ip string, qname string, qtype uint16, edns bool) *dns.Msg {
+	t.Helper()
+
+	rec := newRecorderWithIP(t, ip)
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(qname), qtype)
+	if edns {
+		m.SetEdns0(4096, false)
+	}
+	if _, err := a.ServeDNS(context.Background(), rec, m); err == nil {
+		t.Fatal("ServeDNS error = nil, want the redis error")
+	}
+	return rec.Msg
+}
+
+func TestNegativeResponseWithoutSOA(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	z, err := a.load(exampleZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// redis goes away between loading the zone and reading the apex
+	mr.Close()
+
+	rec := newRecorderWithIP(t, "8.8.8.8")
+	m := new(dns.Msg)
+	m.SetQuestion("nonexistent."+exampleZone, dns.TypeA)
+	if _, err := a.negativeResponse(request.Request{W: rec, Req: m}, z, dns.RcodeNameError); err == nil {
+		t.Fatal("negativeResponse error = nil, want the redis error")
+	}
+	if rec.Msg.Rcode != dns.RcodeServerFailure || len(rec.Msg.Ns) != 0 {
+		t.Fatalf("rcode = %s with %d authority records, want SERVFAIL without SOA", dns.RcodeToString[rec.Msg.Rcode], len(rec.Msg.Ns))
+	}
+}
+
+func extendedErrorOf(m *dns.Msg) *dns.EDNS0_EDE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestServeDNSExtendedErrors(t *testing.T) {
+	a, mr := registrationAutodnsWithNetworks(t, "100.64.0.0/16")
+	a.RegisterDeny = []string{"www"}
+
+	tests := []struct {
+		name     string
+		ip       string
+		qname    string
+		qtype    uint16
+		wantCode int
+		wantEDE  *extendedError
+	}{
+		{name: "register outside networks", ip: "8.8.8.8", qname: "_reg.host9." + exampleZone, qtype: dns.TypeTXT, wantCode: dns.RcodeNameError, wantEDE: edeNotAllowed},
+		{name: "register denied name", ip: "100.64.0.10", qname: "_reg.www." + exampleZone, qtype: dns.TypeTXT, wantCode: dns.RcodeNameError, wantEDE: edeDenied},
+		{name: "acme outside networks", ip: "8.8.8.8", qname: "_acme-reg." + testAcmeDigest + "." + exampleZone, qtype: dns.TypeTXT, wantCode: dns.RcodeNameError, wantEDE: edeNotAllowed},
+		{name: "unsupported type", ip: "8.8.8.8", qname: exampleZone, qtype: dns.TypeHINFO, wantCode: dns.RcodeNotImplemented, wantEDE: edeNotSupported},
+		{name: "missing name", ip: "8.8.8.8", qname: "nonexistent." + exampleZone, qtype: dns.TypeA, wantCode: dns.RcodeNameError},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := serveDNSEdns(t, a, tc.ip, tc.qname, tc.qtype)
+			if resp.Rcode != tc.wantCode {
+				t.Fatalf("rcode = %d, want %d", resp.Rcode, tc.wantCode)
+			}
+			ede := extendedErrorOf(resp)
+			if tc.wantEDE == nil {
+				if ede != nil {
+					t.Fatalf("unexpected EDE %v", ede)
+				}
+				return
+			}
+			if ede == nil || ede.InfoCode != tc.wantEDE.code || ede.ExtraText != tc.wantEDE.text {
+				t.Fatalf("EDE = %v, want %d %q", ede, tc.wantEDE.code, tc.wantEDE.text)
+			}
+		})
+	}
+
+	t.Run("registration write fails", func(t *testing.T) {
+		a.JournalLength = 10
+		defer func() { a.JournalLength = 0 }()
+		// a journal key of the wrong type makes the write script fail
+		mr.Set(a.journalKey(exampleZone), "not a stream")
+		defer mr.Del(a.journalKey(exampleZone))
+
+		resp := serveDNSFailing(t, a, "100.64.0.10", "_reg.host9."+exampleZone, dns.TypeTXT, true)
+		if ede := extendedErrorOf(resp); resp.Rcode != dns.RcodeServerFailure || ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNotReady {
+			t.Fatalf("rcode = %d, EDE = %v, want SERVFAIL with Not Ready", resp.Rcode, ede)
+		}
+	})
+
+	t.Run("redis unavailable", func(t *testing.T) {
+		mr.Close()
+		resp := serveDNSFailing(t, a, "8.8.8.8", exampleZone, dns.TypeA, true)
+		if ede := extendedErrorOf(resp); resp.Rcode != dns.RcodeServerFailure || ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNotReady {
+			t.Fatalf("rcode = %d, EDE = %v, want SERVFAIL with Not Ready", resp.Rcode, ede)
+		}
+	})
+
+	t.Run("no EDE without OPT", func(t *testing.T) {
+		resp := serveDNSFailing(t, a, "8.8.8.8", "_reg.host9."+exampleZone, dns.TypeTXT, false)
+		if resp.IsEdns0() != nil {
+			t.Fatal("OPT added to a query without EDNS")
+		}
+	})
+}
+
+func TestServeDNSNegativeAnswers(t *testing.T) {
+	a, _ := prepareServeDNS(t)
+	soa := test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 303 44 55 66 100")
+
+	tests := []struct {
+		name string
+		tc   test.Case
+	}{
+		{name: "nodata", tc: test.Case{Qname: "host1.example.net.", Qtype: dns.TypeAAAA, Ns: []dns.RR{soa}}},
+		{name: "empty non-terminal", tc: test.Case{Qname: "_tcp.host1.example.net.", Qtype: dns.TypeA, Ns: []dns.RR{soa}}},
+		{name: "soa below apex", tc: test.Case{Qname: "host1.example.net.", Qtype: dns.TypeSOA, Ns: []dns.RR{soa}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := serveDNS(t, a, "127.0.0.1", tc.tc.Qname, tc.tc.Qtype)
+			if err := test.SortAndCheck(resp, tc.tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestServeDNSNXDOMAINAuthority(t *testing.T) {
+	a, mr := newTestAutodns(t)
+	seedRegistrationZone(t, mr, a)
+	mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, "host1", `{"a":[{"ttl":300,"ip":"5.5.5.5"}]}`)
+
+	resp := serveDNS(t, a, "127.0.0.1", "nonexistent.example.net.", dns.TypeA)
+	tc := test.Case{
+		Qname: "nonexistent.example.net.", Qtype: dns.TypeA, Rcode: dns.RcodeNameError,
+		Ns: []dns.RR{test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 303 44 55 66 100")},
+	}
+	if err := test.SortAndCheck(resp, tc); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeDNSAuthorityNS(t *testing.T) {
+	a, _ := prepareServeDNS(t)
+	a.AuthorityNS = true
+
+	resp := serveDNS(t, a, "127.0.0.1", "host1.example.net.", dns.TypeA)
+	tc := test.Case{
+		Qname: "host1.example.net.", Qtype: dns.TypeA,
+		Answer: []dns.RR{test.A("host1.example.net. 300 IN A 5.5.5.5")},
+		Ns: []dns.RR{
+			test.NS("example.net. 300 IN NS ns1.example.net."),
+			test.NS("example.net. 300 IN NS ns2.example.net."),
+		},
+	}
+	if err := test.SortAndCheck(resp, tc); err != nil {
+		t.Error(err)
+	}
+
+	apex := serveDNS(t, a, "127.0.0.1", exampleZone, dns.TypeNS)
+	if len(apex.Ns) != 0 {
+		t.Fatalf("apex NS query repeated NS in authority: %v", apex.Ns)
+	}
+}
+
+func TestServeDNSCNAMEChasing(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	otherKey := a.keyPrefix + "example.org." + a.keySuffix
+	mr.HSet(zoneKey, "web", `{"cname":[{"ttl":300,"host":"host1.example.net."}]}`)
+	mr.HSet(zoneKey, "www", `{"cname":[{"ttl":300,"host":"web.example.net."}]}`)
+	mr.HSet(zoneKey, "loop1", `{"cname":[{"ttl":300,"host":"loop2.example.net."}]}`)
+	mr.HSet(zoneKey, "loop2", `{"cname":[{"ttl":300,"host":"loop1.example.net."}]}`)
+	mr.HSet(zoneKey, "ext", `{"cname":[{"ttl":300,"host":"www.example.com."}]}`)
+	mr.HSet(zoneKey, "cross", `{"cname":[{"ttl":300,"host":"app.example.org."}]}`)
+	mr.HSet(zoneKey, "dangling", `{"cname":[{"ttl":300,"host":"gone.example.net."}]}`)
+	mr.HSet(otherKey, "app", `{"aaaa":[{"ttl":300,"ip":"2001:db8::1"}]}`)
+	a.setZones([]string{exampleZone, "example.org."})
+
+	tests := []test.Case{
+		{
+			Qname: "web.example.net.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("host1.example.net. 300 IN A 5.5.5.5"),
+				test.CNAME("web.example.net. 300 IN CNAME host1.example.net."),
+			},
+		},
+		{
+			Qname: "www.example.net.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.A("host1.example.net. 300 IN A 5.5.5.5"),
+				test.CNAME("web.example.net. 300 IN CNAME host1.example.net."),
+				test.CNAME("www.example.net. 300 IN CNAME web.example.net."),
+			},
+		},
+		{
+			Qname: "loop1.example.net.", Qtype: dns.TypeA,
+			Answer: []dns.RR{
+				test.CNAME("loop1.example.net. 300 IN CNAME loop2.example.net."),
+				test.CNAME("loop2.example.net. 300 IN CNAME loop1.example.net."),
+			},
+		},
+		{
+			Qname: "ext.example.net.", Qtype: dns.TypeA,
+			Answer: []dns.RR{test.CNAME("ext.example.net. 300 IN CNAME www.example.com.")},
+		},
+		{
+			Qname: "cross.example.net.", Qtype: dns.TypeAAAA,
+			Answer: []dns.RR{
+				test.AAAA("app.example.org. 300 IN AAAA 2001:db8::1"),
+				test.CNAME("cross.example.net. 300 IN CNAME app.example.org."),
+			},
+		},
+		{
+			Qname: "web.example.net.", Qtype: dns.TypeCNAME,
+			Answer: []dns.RR{test.CNAME("web.example.net. 300 IN CNAME host1.example.net.")},
+		},
+		{
+			// the chain ends without the queried type: NODATA with the SOA
+			Qname: "web.example.net.", Qtype: dns.TypeMX,
+			Answer: []dns.RR{test.CNAME("web.example.net. 300 IN CNAME host1.example.net.")},
+			Ns:     []dns.RR{test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 303 44 55 66 100")},
+		},
+		{
+			Qname: "dangling.example.net.", Qtype: dns.TypeA,
+			Answer: []dns.RR{test.CNAME("dangling.example.net. 300 IN CNAME gone.example.net.")},
+			Ns:     []dns.RR{test.SOA("example.net. 100 IN SOA ns1.example.net. hostmaster.example.net. 303 44 55 66 100")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.Qname+" "+dns.TypeToString[tc.Qtype], func(t *testing.T) {
+			resp := serveDNS(t, a, "127.0.0.1", tc.Qname, tc.Qtype)
+			if len(resp.Answer) > 0 && resp.Answer[0].Header().Name != tc.Qname {
+				t.Fatalf("answer starts with %s, want the CNAME at %s", resp.Answer[0].Header().Name, tc.Qname)
+			}
+			if err := test.SortAndCheck(resp, tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestChaseCNAMELengthLimit(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+	for i := 0; i < 2*maxCnameChain; i++ {
+		mr.HSet(zoneKey, fmt.Sprintf("c%d", i), fmt.Sprintf(`{"cname":[{"ttl":300,"host":"c%d.example.net."}]}`, i+1))
+	}
+
+	resp := serveDNS(t, a, "127.0.0.1", "c0.example.net.", dns.TypeA)
+	if len(resp.Answer) != maxCnameChain {
+		t.Fatalf("answer has %d records, want %d", len(resp.Answer), maxCnameChain)
+	}
+}
@@ -0,0 +1,36 @@
+package autodns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// listenHTTP starts an optional HTTP listener next to the DNS server.
+func listenHTTP(name, addr string, handler http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	logger.Info(name, " listening on ", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error(name, " server error: ", err)
+		}
+	}()
+	return srv, nil
+}
+
+func shutdownHTTP(srv *http.Server) error {
+	if srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,218 @@
+package autodns
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/miekg/dns"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// journalKeyPrefix starts the per-zone Redis stream recording every change
+// with the serial it produced, for answering IXFR (RFC 1995).
+const journalKeyPrefix = "_autodns:journal:"
+
+const defaultJournalLength = 100
+
+func (autodns *Autodns) journalKey(zone string) string {
+	return autodns.keyPrefix + journalKeyPrefix + zone + autodns.keySuffix
+}
+
+// journalEntry is one change of a zone hash field: its value before and
+// after, and the serials on either side. An empty value means no field.
+type journalEntry struct {
+	from   uint32
+	serial uint32
+	field  string
+	old    string
+	new    string
+}
+
+func (autodns *Autodns) readJournal(zone string) ([]journalEntry, error) {
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+
+	values, err := redisCon.Values(conn.Do("XRANGE", autodns.journalKey(zone), "-", "+"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]journalEntry, 0, len(values))
+	for _, value := range values {
+		parts, err := redisCon.Values(value, nil)
+		if err != nil || len(parts) != 2 {
+			continue
+		}
+		fields, err := redisCon.StringMap(parts[1], nil)
+		if err != nil {
+			continue
+		}
+		from, err1 := strconv.ParseInt(fields["from"], 10, 64)
+		serial, err2 := strconv.ParseInt(fields["serial"], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		entries = append(entries, journalEntry{
+			from:   uint32(from),
+			serial: uint32(serial),
+			field:  fields["field"],
+			old:    fields["old"],
+			new:    fields["new"],
+		})
+	}
+	return entries, nil
+}
+
+// journalChain returns the entries leading from serial to the zone's
+// current serial. It fails when serial is not in the journal any more or
+// the chain has gaps.
+func journalChain(entries []journalEntry, serial, current uint32) ([]journalEntry, bool) {
+	start := -1
+	for i, e := range entries {
+		if e.from == serial {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, false
+	}
+	for i := start; i < len(entries); i++ {
+		if entries[i].from != serial {
+			return nil, false
+		}
+		serial = entries[i].serial
+		if serial == current {
+			return entries[start : i+1], true
+		}
+	}
+	return nil, false
+}
+
+// IXFR answers an incremental transfer from the client's serial (RFC 1995):
+// the current SOA, then for every change the old SOA with the removed
+// records and the new SOA with the added ones, and the current SOA again. A
+// client that is up to date gets the current SOA alone. ok is false when the
+// journal does not reach back to serial and a full transfer is needed.
+func (autodns *Autodns) IXFR(z *Zone, serial uint32) (records []dns.RR, ok bool) {
+	soa, err := autodns.zoneSOA(z)
+	if err != nil {
+		logger.Error("error reading SOA of ", z.Name, ": ", err)
+		return nil, false
+	}
+	// RFC 1982: a client at or ahead of our serial has nothing to fetch
+	if int32(z.Serial-serial) <= 0 {
+		return []dns.RR{soa}, true
+	}
+	entries, err := autodns.readJournal(z.Name)
+	if err != nil {
+		logger.Error("error reading journal of ", z.Name, ": ", err)
+		return nil, false
+	}
+	chain, ok := journalChain(entries, serial, z.Serial)
+	if !ok {
+		return nil, false
+	}
+
+	records = append(records, soa)
+	for _, e := range chain {
+		removed, added := autodns.journalDiff(z, e)
+		records = append(records, soaWithSerial(soa, e.from))
+		records = append(records, removed...)
+		records = append(records, soaWithSerial(soa, e.serial))
+		records = append(records, added...)
+	}
+	records = append(records, soa)
+	return records, true
+}
+
+// journalDiff renders both sides of a change and returns the records only
+// present before and only present after it.
+func (autodns *Autodns) journalDiff(z *Zone, e journalEntry) (removed, added []dns.RR) {
+	before := autodns.journalRRs(z, e.field, e.old)
+	after := autodns.journalRRs(z, e.field, e.new)
+	return rrDifference(before, after), rrDifference(after, before)
+}
+
+func (autodns *Autodns) journalRRs(z *Zone, field, value string) []dns.RR {
+	if value == "" {
+		return nil
+	}
+	record := new(Record)
+	if err := json.Unmarshal([]byte(value), record); err != nil {
+		return nil
+	}
+	return autodns.recordRRs(field, z, record)
+}
+
+// rrDifference returns the records of a that are not in b.
+func rrDifference(a, b []dns.RR) []dns.RR {
+	var diff []dns.RR
+	for _, rr := range a {
+		found := false
+		for _, other := range b {
+			if dns.IsDuplicate(rr, other) && rr.Header().Ttl == other.Header().Ttl {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, rr)
+		}
+	}
+	return diff
+}
+
+// recordRRs renders every RRset of the record stored at field, except the
+// SOA, which transfers send separately. TXT records are rendered as stored:
+// a transfer mirrors the data the serial describes, so expired ACME digests
+// stay until the cleanup deletes them, and the journal entry of that cleanup
+// removes them from secondaries.
+func (autodns *Autodns) recordRRs(field string, z *Zone, record *Record) (records []dns.RR) {
+	name := z.Name
+	if field != "@" && field != z.Name {
+		name = dns.Fqdn(field) + z.Name
+	}
+	for _, qtype := range anyTypes {
+		switch qtype {
+		case "SOA":
+			continue
+		case "TXT":
+			records = append(records, autodns.txtRRs(name, record.TXT)...)
+			continue
+		}
+		answers, _, _ := autodns.answer(qtype, name, z, record)
+		records = append(records, answers...)
+	}
+	return records
+}
+
+// zoneSOA returns the SOA of z as served at the apex.
+func (autodns *Autodns) zoneSOA(z *Zone) (dns.RR, error) {
+	record, err := autodns.get(z.Name, z)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		record = new(Record)
+	}
+	soa, _ := autodns.SOA(z.Name, z, record)
+	return soa[0], nil
+}
+
+func soaWithSerial(soa dns.RR, serial uint32) dns.RR {
+	rr := dns.Copy(soa).(*dns.SOA)
+	rr.Serial = serial
+	return rr
+}
+
+// sortedLocations returns the hash fields of z in a stable order.
+func sortedLocations(z *Zone) []string {
+	keys := make([]string, 0, len(z.Locations))
+	for key := range z.Locations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,245 @@
+package autodns
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func transferRecords(t *testing.T, a *Autodns, serial uint32) []dns.RR {
+	t.Helper()
+
+	ch, err := a.Transfer(exampleZone, serial)
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	var records []dns.RR
+	for rrs := range ch {
+		records = append(records, rrs...)
+	}
+	return records
+}
+
+// transferSummary reduces a transfer to "SOA <serial>" and "<name> <type> <data>"
+// lines for the records of host1.
+func transferSummary(records []dns.RR) []string {
+	var summary []string
+	for _, rr := range records {
+		switch v := rr.(type) {
+		case *dns.SOA:
+			summary = append(summary, fmt.Sprintf("SOA %d", v.Serial))
+		case *dns.A:
+			if v.Hdr.Name == "host1.example.net." {
+				summary = append(summary, "host1 A "+v.A.String())
+			}
+		}
+	}
+	return summary
+}
+
+func journalAutodns(t *testing.T, length int) *Autodns {
+	t.Helper()
+
+	a, mr := prepareServeDNS(t, func(a *Autodns) {
+		a.JournalLength = length
+	})
+	mr.HSet(a.zoneSerialKey(), exampleZone, "100")
+	if err := a.AddARecord(exampleZone, "host1", "6.6.6.6"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DeleteAcmeTXTRecord(exampleZone, "host1"); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestZoneWriteJournal(t *testing.T) {
+	a, mr := prepareServeDNS(t, func(a *Autodns) {
+		a.JournalLength = 10
+	})
+	mr.HSet(a.zoneSerialKey(), exampleZone, "100")
+
+	if err := a.AddARecord(exampleZone, "newhost", "100.64.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	// writing the same value again is not a change
+	if err := a.AddARecord(exampleZone, "newhost", "100.64.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet(a.zoneSerialKey(), exampleZone); got != "101" {
+		t.Fatalf("serial = %s, want 101", got)
+	}
+
+	entries, err := a.readJournal(exampleZone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := journalEntry{from: 100, serial: 101, field: "newhost", new: `{"a": [{"ip": "100.64.0.5", "ttl": 300}]}`}
+	if len(entries) != 1 || entries[0] != want {
+		t.Fatalf("journal = %+v, want [%+v]", entries, want)
+	}
+
+	a.JournalLength = 0
+	if err := a.AddARecord(exampleZone, "other", "100.64.0.6"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := a.readJournal(exampleZone); len(entries) != 1 {
+		t.Fatalf("journal written while disabled: %+v", entries)
+	}
+}
+
+func TestJournalChain(t *testing.T) {
+	entries := []journalEntry{
+		{from: 10, serial: 11},
+		{from: 11, serial: 12},
+		{from: 12, serial: 13},
+	}
+
+	tests := []struct {
+		name    string
+		serial  uint32
+		current uint32
+		want    int
+		ok      bool
+	}{
+		{name: "whole journal", serial: 10, current: 13, want: 3, ok: true},
+		{name: "tail", serial: 12, current: 13, want: 1, ok: true},
+		{name: "stops at current", serial: 10, current: 12, want: 2, ok: true},
+		{name: "older than journal", serial: 9, current: 13},
+		{name: "current beyond journal", serial: 10, current: 14},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, ok := journalChain(entries, tc.serial, tc.current)
+			if ok != tc.ok || len(chain) != tc.want {
+				t.Fatalf("journalChain(%d, %d) = %d entries, %v; want %d, %v", tc.serial, tc.current, len(chain), ok, tc.want, tc.ok)
+			}
+		})
+	}
+
+	gap := []journalEntry{{from: 10, serial: 11}, {from: 12, serial: 13}}
+	if _, ok := journalChain(gap, 10, 13); ok {
+		t.Fatal("chain with a gap accepted")
+	}
+}
+
+func TestTransferIXFR(t *testing.T) {
+	a := journalAutodns(t, 10)
+
+	tests := []struct {
+		name   string
+		serial uint32
+		want   []string
+	}{
+		{
+			name:   "two changes",
+			serial: 100,
+			want: []string{"SOA 102",
+				"SOA 100", "host1 A 5.5.5.5", "SOA 101", "host1 A 6.6.6.6",
+				"SOA 101", "host1 A 6.6.6.6", "SOA 102",
+				"SOA 102"},
+		},
+		{
+			name:   "one change",
+			serial: 101,
+			want:   []string{"SOA 102", "SOA 101", "host1 A 6.6.6.6", "SOA 102", "SOA 102"},
+		},
+		{name: "up to date", serial: 102, want: []string{"SOA 102"}},
+		{name: "ahead of us", serial: 105, want: []string{"SOA 102"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			records := transferRecords(t, a, tc.serial)
+			if got := transferSummary(records); !slices.Equal(got, tc.want) {
+				t.Fatalf("IXFR from %d = %v, want %v", tc.serial, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("older than journal falls back to AXFR", func(t *testing.T) {
+		records := transferRecords(t, a, 50)
+		got := transferSummary(records)
+		if !slices.Equal(got, []string{"SOA 102", "SOA 102"}) {
+			t.Fatalf("AXFR summary = %v", got)
+		}
+		if len(records) < 4 {
+			t.Fatalf("AXFR has %d records", len(records))
+		}
+	})
+}
+
+func TestTransferIXFRTrimmedJournal(t *testing.T) {
+	a := journalAutodns(t, 1)
+
+	if got := transferSummary(transferRecords(t, a, 100)); !slices.Equal(got, []string{"SOA 102", "SOA 102"}) {
+		t.Fatalf("IXFR past the journal = %v, want a full transfer", got)
+	}
+	if got := transferSummary(transferRecords(t, a, 101)); len(got) != 5 {
+		t.Fatalf("IXFR within the journal = %v", got)
+	}
+}
+
+func TestTransferIXFRAcmeExpiry(t *testing.T) {
+	a, mr := prepareServeDNS(t, func(a *Autodns) {
+		a.JournalLength = 10
+		a.AcmeExpire = time.Minute
+	})
+	mr.HSet(a.zoneSerialKey(), exampleZone, "100")
+
+	published := time.Now().Add(-time.Hour).Unix()
+	value := fmt.Sprintf(`{"txt":[{"ttl":120,"text":%q,"published":%d}]}`, testAcmeDigest, published)
+	if err := a.zoneWrite(exampleZone, "_acme-challenge.host1", value); err != nil {
+		t.Fatal(err)
+	}
+	a.CleanupExpiredAcme()
+	if got := mr.HGet(a.zoneSerialKey(), exampleZone); got != "102" {
+		t.Fatalf("serial after cleanup = %s, want 102", got)
+	}
+
+	var removed []string
+	records := transferRecords(t, a, 101)
+	for _, rr := range records {
+		if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Name == "_acme-challenge.host1.example.net." {
+			removed = append(removed, txt.Txt...)
+		}
+	}
+	if !slices.Equal(removed, []string{testAcmeDigest}) || len(records) != 5 {
+		t.Fatalf("IXFR across the cleanup = %v, want the expired digest removed", records)
+	}
+}
+
+func TestJournalSetup(t *testing.T) {
+	for directive, want := range map[string]int{"ixfr.journal 500": 500, "ixfr.journal 0": 0} {
+		a, err := setupFromDirective(t, directive)
+		if err != nil {
+			t.Fatalf("%q: %v", directive, err)
+		}
+		if a.JournalLength != want {
+			t.Fatalf("%q: JournalLength = %d, want %d", directive, a.JournalLength, want)
+		}
+	}
+	a, err := setupFromDirective(t, "")
+	if err != nil || a.JournalLength != defaultJournalLength {
+		t.Fatalf("default JournalLength = %d, %v", a.JournalLength, err)
+	}
+	for _, directive := range []string{"ixfr.journal", "ixfr.journal -1", "ixfr.journal many"} {
+		if _, err := setupFromDirective(t, directive); err == nil {
+			t.Fatalf("%q: expected error", directive)
+		}
+	}
+}
+
+func setupFromDirective(t *testing.T, directive string) (*Autodns, error) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	corefile := fmt.Sprintf("autodns {\naddress %s\n%s\n}", mr.Addr(), directive)
+	return redisSetup(caddy.NewTestController("dns", corefile))
+}
@@ -0,0 +1,90 @@
+package autodns
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// labelNode is one name in the zone's label tree. A node exists for every
+// hash field and for every name above one (empty non-terminals); key is the
+// hash field for nodes holding data.
+type labelNode struct {
+	children map[string]*labelNode
+	key      string
+	data     bool
+}
+
+func newLabelTree(locations map[string]struct{}) *labelNode {
+	root := &labelNode{}
+	for key := range locations {
+		if key == "@" {
+			root.key, root.data = key, true
+			continue
+		}
+		node := root
+		labels := dns.SplitDomainName(key)
+		for i := len(labels) - 1; i >= 0; i-- {
+			label := strings.ToLower(labels[i])
+			child, ok := node.children[label]
+			if !ok {
+				child = &labelNode{}
+				if node.children == nil {
+					node.children = make(map[string]*labelNode)
+				}
+				node.children[label] = child
+			}
+			node = child
+		}
+		node.key, node.data = key, true
+	}
+	return root
+}
+
+// labels returns the label tree of the zone, building it on first use.
+func (z *Zone) labels() *labelNode {
+	z.treeOnce.Do(func() {
+		z.tree = newLabelTree(z.Locations)
+	})
+	return z.tree
+}
+
+// relativeLabels splits name below the zone apex into labels, leftmost first.
+// ok is false for names outside the zone.
+func relativeLabels(name string, z *Zone) (labels []string, ok bool) {
+	name = strings.ToLower(name)
+	if name == z.Name {
+		return nil, true
+	}
+	if !strings.HasSuffix(name, "."+z.Name) {
+		return nil, false
+	}
+	return dns.SplitDomainName(strings.TrimSuffix(name, "."+z.Name)), true
+}
+
+// closestEncloser walks labels (leftmost first) down the tree and returns the
+// deepest existing node and how many labels, counted from the right, it matched.
+func (root *labelNode) closestEncloser(labels []string) (*labelNode, int) {
+	node := root
+	depth := 0
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+		depth++
+	}
+	return node, depth
+}
+
+// lookup resolves name per RFC 4592. exact is the node of name itself when it
+// exists; otherwise wildcard is the source of synthesis *.<closest encloser>
+// when that exists.
+func (root *labelNode) lookup(labels []string) (exact, wildcard *labelNode) {
+	ce, depth := root.closestEncloser(labels)
+	if depth == len(labels) {
+		return ce, nil
+	}
+	return nil, ce.children["*"]
+}
@@ -0,0 +1,158 @@
+package autodns
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// referenceLocation resolves query by brute force over the field names, as
+// written in RFC 4592 section 3.3.1.
+func referenceLocation(query string, locations map[string]struct{}) (location string, emptyNonTerminal bool) {
+	if query == exampleZone {
+		return query, false
+	}
+	name := strings.TrimSuffix(query, "."+exampleZone)
+	exists := func(n string) bool {
+		if n == "" {
+			return true
+		}
+		for key := range locations {
+			if key == n || strings.HasSuffix(key, "."+n) {
+				return true
+			}
+		}
+		return false
+	}
+	_, data := locations[name]
+	if data {
+		return name, false
+	}
+	if exists(name) {
+		return "", true
+	}
+	ce := name
+	for !exists(ce) {
+		if i := strings.Index(ce, "."); i >= 0 {
+			ce = ce[i+1:]
+		} else {
+			ce = ""
+		}
+	}
+	source := "*"
+	if ce != "" {
+		source = "*." + ce
+	}
+	if _, ok := locations[source]; ok {
+		return source, false
+	}
+	return "", exists(source)
+}
+
+func TestFindLocationRFC4592(t *testing.T) {
+	// the zone from RFC 4592 section 2.2.1
+	locations := map[string]struct{}{
+		"@": {}, "*": {}, "host1": {}, "_ssh._tcp.host1": {}, "_ssh._tcp.host2": {},
+		"subdel": {}, "*.foo.bar": {},
+	}
+	a := &Autodns{}
+	z := &Zone{Name: exampleZone, Locations: locations}
+
+	tests := []struct {
+		query   string
+		want    string
+		wantENT bool
+	}{
+		{query: "host3.example.net.", want: "*"},
+		{query: "_ssh._tcp.host1.example.net.", want: "_ssh._tcp.host1"},
+		{query: "_telnet._tcp.host1.example.net.", want: ""},        // closest encloser _tcp.host1 has no *
+		{query: "_tcp.host1.example.net.", want: "", wantENT: true}, // empty non-terminal
+		{query: "host.subdel.example.net.", want: ""},               // closest encloser subdel has no *
+		{query: "ghost.*.example.net.", want: ""},                   // closest encloser is *, and *.* does not exist
+		{query: "bar.example.net.", want: "", wantENT: true},        // ENT above *.foo.bar
+		{query: "x.foo.bar.example.net.", want: "*.foo.bar"},
+		{query: "a.ost1.example.net.", want: "*"}, // ost1 is not an ancestor of host1
+		{query: "HOST1.example.net.", want: "host1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			query := strings.ToLower(tc.query)
+			if got := a.findLocation(query, z); got != tc.want {
+				t.Fatalf("findLocation = %q, want %q", got, tc.want)
+			}
+			if got := isEmptyNonTerminal(query, z); got != tc.wantENT {
+				t.Fatalf("isEmptyNonTerminal = %v, want %v", got, tc.wantENT)
+			}
+		})
+	}
+}
+
+func TestFindLocationRandomized(t *testing.T) {
+	alphabet := []string{"a", "b", "c", "*", "_x", "ab"}
+	randomName := func(r *rand.Rand) string {
+		labels := make([]string, 1+r.Intn(4))
+		for i := range labels {
+			labels[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return strings.Join(labels, ".")
+	}
+
+	r := rand.New(rand.NewSource(4592))
+	a := &Autodns{}
+	for round := 0; round < 200; round++ {
+		locations := map[string]struct{}{"@": {}}
+		for i := r.Intn(12); i > 0; i-- {
+			locations[randomName(r)] = struct{}{}
+		}
+		z := &Zone{Name: exampleZone, Locations: locations}
+		for i := 0; i < 50; i++ {
+			query := randomName(r) + "." + exampleZone
+			want, wantENT := referenceLocation(query, locations)
+			if got := a.findLocation(query, z); got != want {
+				t.Fatalf("zone %v: findLocation(%q) = %q, want %q", locations, query, got, want)
+			}
+			if got := isEmptyNonTerminal(query, z); got != wantENT {
+				t.Fatalf("zone %v: isEmptyNonTerminal(%q) = %v, want %v", locations, query, got, wantENT)
+			}
+		}
+	}
+}
+
+func FuzzFindLocation(f *testing.F) {
+	f.Add("host1,*,_ssh._tcp.host1", "a.ost1")
+	f.Add("*.foo.bar,sub.*", "x.y.foo.bar")
+	f.Add("a.b.c", "b.c")
+	a := &Autodns{}
+	f.Fuzz(func(t *testing.T, keys, query string) {
+		locations := map[string]struct{}{"@": {}}
+		for _, key := range strings.Split(keys, ",") {
+			if valid := validFuzzName(key); valid {
+				locations[key] = struct{}{}
+			}
+		}
+		if !validFuzzName(query) {
+			return
+		}
+		z := &Zone{Name: exampleZone, Locations: locations}
+		want, wantENT := referenceLocation(query+"."+exampleZone, locations)
+		if got := a.findLocation(query+"."+exampleZone, z); got != want {
+			t.Fatalf("zone %v: findLocation(%q) = %q, want %q", locations, query, got, want)
+		}
+		if got := isEmptyNonTerminal(query+"."+exampleZone, z); got != wantENT {
+			t.Fatalf("zone %v: isEmptyNonTerminal(%q) = %v, want %v", locations, query, got, wantENT)
+		}
+	})
+}
+
+// validFuzzName accepts lowercase relative names without empty labels.
+func validFuzzName(name string) bool {
+	if name == "" || name == "@" || strings.ToLower(name) != name {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || strings.ContainsAny(label, "\\\" ") {
+			return false
+		}
+	}
+	return true
+}
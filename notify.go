@@ -0,0 +1,67 @@
+package autodns
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	notifyTimeout = 2 * time.Second
+	notifyRetries = 5
+)
+
+// notifyRetryInterval is the wait before the first retry; it doubles after
+// every failed attempt.
+var notifyRetryInterval = time.Second
+
+// notifySecondaries sends a DNS NOTIFY (RFC 1996) for zone to every notify
+// target and every transfer destination in the background.
+func (autodns *Autodns) notifySecondaries(zone string) {
+	autodns.notifyTransfer(zone)
+	for _, target := range autodns.NotifyTargets {
+		go autodns.sendNotify(zone, target, notifyRetryInterval)
+	}
+}
+
+// sendNotify delivers one NOTIFY, retrying until target acknowledges it or
+// notifyRetries attempts have failed.
+func (autodns *Autodns) sendNotify(zone, target string, wait time.Duration) error {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	c := &dns.Client{Timeout: notifyTimeout}
+
+	return autodns.retryNotify(zone, target, wait, func() error {
+		reply, _, err := c.Exchange(m, target)
+		if err != nil {
+			return err
+		}
+		if reply.Rcode != dns.RcodeSuccess {
+			return fmt.Errorf("rcode %s", dns.RcodeToString[reply.Rcode])
+		}
+		return nil
+	})
+}
+
+// retryNotify calls send until it succeeds or notifyRetries attempts have
+// failed, waiting wait before the first retry and twice as long after every
+// further failure. Callers pass notifyRetryInterval before going to the
+// background.
+func (autodns *Autodns) retryNotify(zone, target string, wait time.Duration, send func() error) error {
+	var err error
+	for attempt := 0; attempt < notifyRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = send(); err == nil {
+			if autodns.Verbose {
+				logger.Info("NOTIFY for ", zone, " acknowledged by ", target)
+			}
+			return nil
+		}
+	}
+	logger.Warningf("NOTIFY for %s to %s failed after %d attempts: %s", zone, target, notifyRetries, err)
+	return err
+}
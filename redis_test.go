@@ -9,9 +9,9 @@ func TestLoad(t *testing.T) {
 	a, mr := newTestAutodns(t)
 	seedExampleZone(t, mr, a)
 
-	z := a.load(exampleZone)
-	if z == nil {
-		t.Fatal("load returned nil")
+	z, err := a.load(exampleZone)
+	if err != nil {
+		t.Fatal(err)
 	}
 	if z.Name != exampleZone {
 		t.Fatalf("zone name = %q, want %q", z.Name, exampleZone)
@@ -26,18 +26,21 @@ func TestLoad(t *testing.T) {
 func TestGet(t *testing.T) {
 	a, mr := newTestAutodns(t)
 	seedExampleZone(t, mr, a)
-	z := a.load(exampleZone)
+	z, err := a.load(exampleZone)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	t.Run("apex", func(t *testing.T) {
-		rec := a.get(exampleZone, z)
-		if rec == nil || rec.SOA.Ns != "ns1.example.net." {
+		rec, err := a.get(exampleZone, z)
+		if err != nil || rec == nil || rec.SOA.Ns != "ns1.example.net." {
 			t.Fatalf("apex SOA: %+v", rec)
 		}
 	})
 
 	t.Run("host1 A", func(t *testing.T) {
-		rec := a.get("host1", z)
-		if rec == nil || len(rec.A) != 1 || rec.A[0].Ip.String() != "5.5.5.5" {
+		rec, err := a.get("host1", z)
+		if err != nil || rec == nil || len(rec.A) != 1 || rec.A[0].Ip.String() != "5.5.5.5" {
 			t.Fatalf("host1 A: %+v", rec)
 		}
 	})
@@ -46,8 +49,14 @@ func TestGet(t *testing.T) {
 		zoneKey := a.keyPrefix + exampleZone + a.keySuffix
 		mr.HSet(zoneKey, "bad", "not-json")
 		z.Locations["bad"] = struct{}{}
-		if rec := a.get("bad", z); rec != nil {
-			t.Fatalf("expected nil for invalid JSON, got %+v", rec)
+		if rec, err := a.get("bad", z); err == nil {
+			t.Fatalf("expected an error for invalid JSON, got %+v", rec)
+		}
+	})
+
+	t.Run("missing field", func(t *testing.T) {
+		if rec, err := a.get("nothere", z); err != nil || rec != nil {
+			t.Fatalf("get = %+v, %v; want nil, nil", rec, err)
 		}
 	})
 }
@@ -62,8 +71,8 @@ func TestLoadZones(t *testing.T) {
 		mr.HSet(zoneKey, "host1", `{"a":[{"ttl":300,"ip":"1.2.3.4"}]}`)
 
 		a.LoadZones()
-		if len(a.Zones) != 1 || a.Zones[0] != exampleZone {
-			t.Fatalf("zones = %v, want [%q]", a.Zones, exampleZone)
+		if len(a.zones()) != 1 || a.zones()[0] != exampleZone {
+			t.Fatalf("zones = %v, want [%q]", a.zones(), exampleZone)
 		}
 	})
 
@@ -74,19 +83,19 @@ func TestLoadZones(t *testing.T) {
 		a.LoadZones()
 
 		found := false
-		for _, z := range a.Zones {
+		for _, z := range a.zones() {
 			if z == "newzone.example." {
 				found = true
 				break
 			}
 		}
 		if !found {
-			t.Fatalf("autocreate zone missing from %v", a.Zones)
+			t.Fatalf("autocreate zone missing from %v", a.zones())
 		}
 
-		z := a.load("newzone.example.")
-		if z == nil {
-			t.Fatal("autocreated zone load returned nil")
+		z, err := a.load("newzone.example.")
+		if err != nil {
+			t.Fatal(err)
 		}
 		if _, ok := z.Locations["@"]; !ok {
 			t.Fatal("autocreated zone missing @ SOA")
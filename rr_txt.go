@@ -1,12 +1,25 @@
 package autodns
 
 import (
+	"strings"
+	"time"
+
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
 
 func (autodns *Autodns) TXT(name string, z *Zone, record *Record) (answers, extras []dns.RR) {
-	for _, txt := range record.TXT {
+	field := strings.TrimSuffix(strings.ToLower(dns.Fqdn(name)), "."+z.Name)
+	if !isAcmeChallengeField(field) && !autodns.isDelegatedAcmeField(z.Name, field) {
+		return autodns.txtRRs(name, record.TXT), nil
+	}
+	// hide expired ACME digests until CleanupExpiredAcme removes them
+	return autodns.txtRRs(name, autodns.dropExpiredAcme(record.TXT, time.Now())), nil
+}
+
+// txtRRs renders TXT records as stored, expired ACME digests included.
+func (autodns *Autodns) txtRRs(name string, txts []TXT_Record) (answers []dns.RR) {
+	for _, txt := range txts {
 		if len(txt.Text) == 0 {
 			continue
 		}
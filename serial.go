@@ -0,0 +1,169 @@
+package autodns
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// zoneSerialKey is a hash holding the SOA serial of every zone, bumped by each
+// write to the zone hash.
+const zoneSerialKey = "_autodns:serials"
+
+func (autodns *Autodns) zoneSerialKey() string {
+	return autodns.keyPrefix + zoneSerialKey + autodns.keySuffix
+}
+
+// zoneSerial returns the stored serial of zone. A zone without one starts at
+// the current Unix time, which keeps serials moving forward for secondaries
+// that saw the time based serials served before they were stored.
+func (autodns *Autodns) zoneSerial(conn redisCon.Conn, zone string) (uint32, error) {
+	serial, err := redisCon.Int64(conn.Do("HGET", autodns.zoneSerialKey(), zone))
+	if err == redisCon.ErrNil {
+		if _, err = conn.Do("HSETNX", autodns.zoneSerialKey(), zone, time.Now().Unix()); err != nil {
+			return 0, err
+		}
+		serial, err = redisCon.Int64(conn.Do("HGET", autodns.zoneSerialKey(), zone))
+	}
+	if err != nil {
+		return 0, err
+	}
+	// RFC 1982 serial arithmetic: the counter wraps modulo 2^32
+	return uint32(serial), nil
+}
+
+// zoneWriteScript sets (or, with an empty value, deletes) one field of the
+// zone hash, bumps the zone serial and appends the change to the journal,
+// all atomically. Writes that leave the field as it was change nothing. With
+// an expected value the write only happens while the field still holds it.
+//
+// KEYS: zone hash, serial hash, journal stream
+// ARGV: zone, current Unix time, journal length, field, value[, expected]
+var zoneWriteScript = redisCon.NewScript(3, `
+local old = redis.call('HGET', KEYS[1], ARGV[4]) or ''
+if ARGV[6] and old ~= ARGV[6] then
+	return {tonumber(redis.call('HGET', KEYS[2], ARGV[1]) or 0), -1}
+end
+if old == ARGV[5] then
+	return {tonumber(redis.call('HGET', KEYS[2], ARGV[1]) or 0), 0}
+end
+if ARGV[5] == '' then
+	redis.call('HDEL', KEYS[1], ARGV[4])
+else
+	redis.call('HSET', KEYS[1], ARGV[4], ARGV[5])
+end
+redis.call('HSETNX', KEYS[2], ARGV[1], ARGV[2])
+local from = redis.call('HGET', KEYS[2], ARGV[1])
+local serial = redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+if tonumber(ARGV[3]) > 0 then
+	redis.call('XADD', KEYS[3], 'MAXLEN', '~', ARGV[3], '*',
+		'from', from, 'serial', serial, 'field', ARGV[4], 'old', old, 'new', ARGV[5])
+end
+return {serial, 1}
+`)
+
+// zoneWrite stores value in field of the zone hash, or deletes the field when
+// value is empty. The serial bump and journal entry happen in the same step,
+// so nobody sees the change without them. Secondaries are notified afterwards.
+func (autodns *Autodns) zoneWrite(zone, field, value string) error {
+	_, err := autodns.zoneWriteArgs(zone, field, value)
+	return err
+}
+
+// zoneReplace is zoneWrite for a read-modify-write: it only stores value while
+// field still holds old ("" for a missing field), and reports whether it did.
+func (autodns *Autodns) zoneReplace(zone, field, old, value string) (bool, error) {
+	return autodns.zoneWriteArgs(zone, field, value, old)
+}
+
+func (autodns *Autodns) zoneWriteArgs(zone, field, value string, expected ...string) (bool, error) {
+	conn := autodns.Pool.Get()
+	if conn == nil {
+		return false, errors.New("error connecting to redis")
+	}
+	defer conn.Close()
+
+	args := []interface{}{
+		autodns.keyPrefix + zone + autodns.keySuffix, autodns.zoneSerialKey(), autodns.journalKey(zone),
+		zone, time.Now().Unix(), autodns.JournalLength, field, value,
+	}
+	for _, e := range expected {
+		args = append(args, e)
+	}
+	reply, err := redisCon.Int64s(zoneWriteScript.Do(conn, args...))
+	if err != nil {
+		return false, err
+	}
+	if len(reply) != 2 || reply[1] < 0 {
+		return false, nil
+	}
+	if reply[1] == 0 {
+		return true, nil
+	}
+
+	autodns.sawSerial(zone, uint32(reply[0]))
+	autodns.invalidateZone(zone)
+	autodns.notifySecondaries(zone)
+	return true, nil
+}
+
+// serialWatch remembers the last serial seen for every zone, so bumps made
+// outside the plugin, like admin edits with HINCRBY, are announced too.
+type serialWatch struct {
+	mu      sync.Mutex
+	serials map[string]uint32
+}
+
+// sawSerial records a serial this instance produced and already notified.
+func (autodns *Autodns) sawSerial(zone string, serial uint32) {
+	w := &autodns.serialWatch
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.serials != nil {
+		w.serials[zone] = serial
+	}
+}
+
+// checkSerials sends NOTIFY for every served zone whose stored serial moved
+// since the last check, and drops cached zones that still carry an older
+// serial. The first check only records the serials.
+func (autodns *Autodns) checkSerials() {
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+
+	stored, err := redisCon.Int64Map(conn.Do("HGETALL", autodns.zoneSerialKey()))
+	if err != nil {
+		logger.Error("error reading zone serials: ", err)
+		return
+	}
+
+	var changed []string
+	w := &autodns.serialWatch
+	w.mu.Lock()
+	first := w.serials == nil
+	if first {
+		w.serials = make(map[string]uint32)
+	}
+	for _, zone := range autodns.zones() {
+		value, ok := stored[zone]
+		if !ok {
+			continue
+		}
+		serial := uint32(value)
+		if autodns.zoneCache != nil {
+			autodns.zoneCache.invalidateSerial(zone, serial)
+		}
+		if last, seen := w.serials[zone]; seen && last != serial {
+			changed = append(changed, zone)
+		}
+		w.serials[zone] = serial
+	}
+	w.mu.Unlock()
+
+	for _, zone := range changed {
+		logger.Info("serial of ", zone, " changed outside the plugin, notifying secondaries")
+		autodns.notifySecondaries(zone)
+	}
+}
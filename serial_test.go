@@ -0,0 +1,221 @@
+package autodns
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func soaSerial(t *testing.T, a *Autodns) uint32 {
+	t.Helper()
+
+	resp := serveDNS(t, a, "8.8.8.8", exampleZone, dns.TypeSOA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("SOA answers = %v", resp.Answer)
+	}
+	return resp.Answer[0].(*dns.SOA).Serial
+}
+
+func TestZoneSerialStartsAtUnixTime(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	before := uint32(time.Now().Unix())
+
+	serial := soaSerial(t, a)
+	if serial < before || serial > before+5 {
+		t.Fatalf("initial serial = %d, want about %d", serial, before)
+	}
+	if stored := mr.HGet(a.zoneSerialKey(), exampleZone); stored != strconv.Itoa(int(serial)) {
+		t.Fatalf("stored serial = %q, want %d", stored, serial)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if again := soaSerial(t, a); again != serial {
+		t.Fatalf("serial changed without a write: %d -> %d", serial, again)
+	}
+}
+
+func TestZoneWriteBumpsSerial(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	mr.HSet(a.zoneSerialKey(), exampleZone, "2024010100")
+
+	if err := a.AddARecord(exampleZone, "newhost", "100.64.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if got := soaSerial(t, a); got != 2024010101 {
+		t.Fatalf("serial after registration = %d, want 2024010101", got)
+	}
+	if err := a.DeleteAcmeTXTRecord(exampleZone, "newhost"); err != nil {
+		t.Fatal(err)
+	}
+	if got := soaSerial(t, a); got != 2024010102 {
+		t.Fatalf("serial after delete = %d, want 2024010102", got)
+	}
+
+	// a zone without a stored serial starts from the clock before the bump
+	before := time.Now().Unix()
+	if err := a.AddARecord("example.org.", "host", "100.64.0.6"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := strconv.ParseInt(mr.HGet(a.zoneSerialKey(), "example.org."), 10, 64)
+	if stored < before+1 || stored > before+6 {
+		t.Fatalf("first serial of example.org. = %d, want about %d", stored, before+1)
+	}
+}
+
+func TestZoneSerialWraps(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	mr.HSet(a.zoneSerialKey(), exampleZone, "4294967301")
+
+	if got := soaSerial(t, a); got != 5 {
+		t.Fatalf("serial = %d, want 5", got)
+	}
+}
+
+func TestNotifyOnWrite(t *testing.T) {
+	defer func(interval time.Duration) { notifyRetryInterval = interval }(notifyRetryInterval)
+	notifyRetryInterval = 10 * time.Millisecond
+
+	var attempts atomic.Int32
+	received := make(chan *dns.Msg, 4)
+	port := startStandIn(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		// the first NOTIFY is refused to exercise the retry
+		if attempts.Add(1) == 1 {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			received <- r
+		}
+		_ = w.WriteMsg(m)
+	}))
+
+	a, _ := prepareServeDNS(t, func(a *Autodns) {
+		a.NotifyTargets = []string{net.JoinHostPort("127.0.0.1", port)}
+	})
+	if err := a.AddARecord(exampleZone, "newhost", "100.64.0.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-received:
+		if r.Opcode != dns.OpcodeNotify || !r.Authoritative {
+			t.Fatalf("opcode %s aa %v, want authoritative NOTIFY", dns.OpcodeToString[r.Opcode], r.Authoritative)
+		}
+		if q := r.Question[0]; q.Name != exampleZone || q.Qtype != dns.TypeSOA {
+			t.Fatalf("question = %v", q)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no NOTIFY received")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Fatalf("attempts = %d, want 2", n)
+	}
+}
+
+// notifyRecorder starts a secondary that acknowledges NOTIFYs after refusing
+// the first refuse of them and reports the acknowledged ones.
+func notifyRecorder(t *testing.T, refuse int32) (string, chan string) {
+	t.Helper()
+
+	var attempts atomic.Int32
+	received := make(chan string, 16)
+	port := startStandIn(t, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if attempts.Add(1) <= refuse {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			received <- r.Question[0].Name
+		}
+		_ = w.WriteMsg(m)
+	}))
+	return net.JoinHostPort("127.0.0.1", port), received
+}
+
+func TestNotifyOnExternalSerialBump(t *testing.T) {
+	target, received := notifyRecorder(t, 0)
+	a, mr := prepareServeDNS(t, func(a *Autodns) {
+		a.NotifyTargets = []string{target}
+	})
+	mr.HSet(a.zoneSerialKey(), exampleZone, "100")
+	a.checkSerials()
+
+	// an admin edit outside the plugin
+	mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, "www", `{"a":[{"ip":"192.0.2.10"}]}`)
+	mr.HIncr(a.zoneSerialKey(), exampleZone, 1)
+	a.checkSerials()
+	select {
+	case zone := <-received:
+		if zone != exampleZone {
+			t.Fatalf("NOTIFY for %s, want %s", zone, exampleZone)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no NOTIFY for the external serial bump")
+	}
+
+	// our own writes are notified once, not again by the check
+	if err := a.AddARecord(exampleZone, "newhost", "100.64.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	a.checkSerials()
+	select {
+	case zone := <-received:
+		t.Fatalf("second NOTIFY for %s", zone)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNotifyTransferRetries(t *testing.T) {
+	defer func(interval time.Duration) { notifyRetryInterval = interval }(notifyRetryInterval)
+	notifyRetryInterval = 10 * time.Millisecond
+
+	// the transfer plugin tries three times itself before we retry
+	target, received := notifyRecorder(t, 3)
+	a, _ := prepareServeDNS(t)
+	a.transfer.Store(transferPlugin(t, a, fmt.Sprintf("transfer example.net {\n to %s\n}", target)))
+
+	a.notifyTransfer(exampleZone)
+	select {
+	case zone := <-received:
+		if zone != exampleZone {
+			t.Fatalf("NOTIFY for %s, want %s", zone, exampleZone)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("NOTIFY to the transfer destination not retried")
+	}
+}
+
+func TestNotifySetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	corefile := fmt.Sprintf(`autodns {
+		address %s
+		notify 192.0.2.1 192.0.2.2:5353 2001:db8::53
+	}`, mr.Addr())
+	a, err := redisSetup(caddy.NewTestController("dns", corefile))
+	if err != nil {
+		t.Fatalf("redisSetup error: %v", err)
+	}
+	want := []string{"192.0.2.1:53", "192.0.2.2:5353", "[2001:db8::53]:53"}
+	if !slices.Equal(a.NotifyTargets, want) {
+		t.Fatalf("NotifyTargets = %v, want %v", a.NotifyTargets, want)
+	}
+
+	for _, directive := range []string{"notify", "notify ns2.example.net"} {
+		corefile := fmt.Sprintf(`autodns {
+			address %s
+			%s
+		}`, mr.Addr(), directive)
+		if _, err := redisSetup(caddy.NewTestController("dns", corefile)); err == nil {
+			t.Fatalf("%q: expected error, got nil", directive)
+		}
+	}
+}
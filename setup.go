@@ -2,13 +2,17 @@ package autodns
 
 import (
 	"net"
+	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
 )
 
 var logger = log.NewWithPlugin("autodns")
@@ -31,6 +35,43 @@ func setup(c *caddy.Controller) error {
 		return r
 	})
 
+	// hook up the transfer plugin before the HTTP listeners start, as their
+	// writes send NOTIFY through it
+	c.OnStartup(func() error {
+		if t, ok := dnsserver.GetConfig(c).Handler("transfer").(*transfer.Transfer); ok {
+			r.useTransfer(t)
+		}
+		return nil
+	})
+
+	if r.DyndnsListen != "" {
+		c.OnStartup(r.startDyndns)
+		c.OnShutdown(r.stopDyndns)
+	}
+
+	if r.AcmednsListen != "" {
+		c.OnStartup(r.startAcmedns)
+		c.OnShutdown(r.stopAcmedns)
+	}
+
+	if len(r.AcmeCertificates) > 0 {
+		c.OnStartup(r.startCertificates)
+		c.OnShutdown(r.stopCertificates)
+	}
+
+	c.OnStartup(r.startZoneRefresh)
+	c.OnShutdown(r.stopZoneRefresh)
+
+	if r.zoneCache != nil {
+		c.OnStartup(r.startZoneCache)
+		c.OnShutdown(r.stopZoneCache)
+	}
+
+	if r.AcmeExpire > 0 {
+		c.OnStartup(r.startAcmeCleanup)
+		c.OnShutdown(r.stopAcmeCleanup)
+	}
+
 	if r.Verbose {
 		logger.Info("Configuration:")
 		logger.Info("\tHost: ", r.redisAddress)
@@ -56,18 +97,21 @@ func setup(c *caddy.Controller) error {
 
 func redisSetup(c *caddy.Controller) (*Autodns, error) {
 	autodns := Autodns{
-		keyPrefix: "",
-		keySuffix: "",
-		Ttl:       300,
-		AcmeRrTtl:  defaultAcmeRrTtl,
-		AcmeRotate: defaultAcmeRotate,
-		Verbose:   false,
+		keyPrefix:     "",
+		keySuffix:     "",
+		Ttl:           300,
+		AcmeRrTtl:     defaultAcmeRrTtl,
+		AcmeRotate:    defaultAcmeRotate,
+		AcmeDirectory: defaultAcmeDirectory,
+		JournalLength: defaultJournalLength,
+		Verbose:       false,
 	}
 	var (
 		err error
 	)
 
 	for c.Next() {
+		autodns.Origins = plugin.OriginsFromArgsOrServerBlock(c.RemainingArgs(), c.ServerBlockKeys)
 		if c.NextBlock() {
 			for {
 				switch c.Val() {
@@ -195,6 +239,240 @@ func redisSetup(c *caddy.Controller) (*Autodns, error) {
 						val = defaultAcmeRotate
 					}
 					autodns.AcmeRotate = val
+				case "acme.expire":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					var val int
+					val, err = strconv.Atoi(c.Val())
+					if err != nil || val < 0 {
+						return &Autodns{}, c.Errf("invalid acme.expire '%s'", c.Val())
+					}
+					autodns.AcmeExpire = time.Duration(val) * time.Second
+				case "acmedns.listen":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					autodns.AcmednsListen = c.Val()
+					logger.Info("acme-dns listen: ", autodns.AcmednsListen)
+				case "acmedns.zone":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					autodns.AcmednsZone = UniformZone(c.Val())
+				case "acme.certificate":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Autodns{}, c.ArgErr()
+					}
+					names := make([]string, 0, len(args))
+					for _, name := range args {
+						names = append(names, strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), "."))
+					}
+					autodns.AcmeCertificates = append(autodns.AcmeCertificates, names)
+					logger.Info("ACME Certificate: ", strings.Join(names, " "))
+				case "acme.directory":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					autodns.AcmeDirectory = c.Val()
+				case "acme.email":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					autodns.AcmeEmail = c.Val()
+				case "acme.caa":
+					args := c.RemainingArgs()
+					if len(args) == 0 || len(args) > 2 {
+						return &Autodns{}, c.ArgErr()
+					}
+					issuer := caaIssuer{Domain: strings.ToLower(strings.TrimSuffix(args[0], "."))}
+					if len(args) == 2 {
+						issuer.AccountURI = args[1]
+					}
+					logger.Info("ACME CAA issuer: ", issuer.Domain, " ", issuer.AccountURI)
+					autodns.AcmeCaa = append(autodns.AcmeCaa, issuer)
+				case "acme.persist":
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return &Autodns{}, c.ArgErr()
+					}
+					issuer := persistIssuer{Domain: strings.ToLower(strings.TrimSuffix(args[0], ".")), AccountURI: args[1]}
+					logger.Info("ACME persistent validation issuer: ", renderPersistValue(issuer, false))
+					autodns.AcmePersist = append(autodns.AcmePersist, issuer)
+				case "acme.caa.iodef":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					autodns.AcmeCaaIodef = c.Val()
+				case "acme.delegate":
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return &Autodns{}, c.ArgErr()
+					}
+					d := acmeDelegation{Domain: UniformZone(args[0]), Target: UniformZone(args[1])}
+					for _, ip := range args[2:] {
+						_, ipnet, err := net.ParseCIDR(strings.TrimSpace(ip))
+						if err != nil {
+							logger.Info("Error: ", err)
+							return &Autodns{}, c.ArgErr()
+						}
+						d.Networks = append(d.Networks, *ipnet)
+					}
+					logger.Info("ACME Delegation: ", d.Domain, " -> ", d.Target)
+					autodns.AcmeDelegations = append(autodns.AcmeDelegations, d)
+				case "zones":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					mode := c.Val()
+					if mode != "allow" && mode != "deny" {
+						return &Autodns{}, c.Errf("invalid zones mode '%s', want allow or deny", mode)
+					}
+					globs := c.RemainingArgs()
+					if len(globs) == 0 {
+						return &Autodns{}, c.ArgErr()
+					}
+					for _, glob := range globs {
+						glob = strings.ToLower(dns.Fqdn(glob))
+						if _, err := path.Match(glob, ""); err != nil {
+							return &Autodns{}, c.Errf("invalid zones %s glob '%s'", mode, glob)
+						}
+						if mode == "allow" {
+							autodns.ZonesAllow = append(autodns.ZonesAllow, glob)
+						} else {
+							autodns.ZonesDeny = append(autodns.ZonesDeny, glob)
+						}
+					}
+					logger.Info("Zones ", mode, ": ", globs)
+				case "notify":
+					targets := c.RemainingArgs()
+					if len(targets) == 0 {
+						return &Autodns{}, c.ArgErr()
+					}
+					for _, target := range targets {
+						if _, _, err := net.SplitHostPort(target); err != nil {
+							target = net.JoinHostPort(target, "53")
+						}
+						host, _, _ := net.SplitHostPort(target)
+						if net.ParseIP(host) == nil {
+							return &Autodns{}, c.Errf("invalid notify target '%s'", target)
+						}
+						autodns.NotifyTargets = append(autodns.NotifyTargets, target)
+					}
+					logger.Info("NOTIFY targets: ", autodns.NotifyTargets)
+				case "ixfr.journal":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					autodns.JournalLength, err = strconv.Atoi(c.Val())
+					if err != nil || autodns.JournalLength < 0 {
+						return &Autodns{}, c.Errf("invalid ixfr.journal '%s'", c.Val())
+					}
+				case "zone_refresh":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					var val int
+					val, err = strconv.Atoi(c.Val())
+					if err != nil || val <= 0 {
+						return &Autodns{}, c.Errf("invalid zone_refresh '%s'", c.Val())
+					}
+					autodns.ZoneRefresh = time.Duration(val) * time.Second
+				case "zone_cache":
+					maxAge := defaultZoneCacheMaxAge
+					if c.NextArg() {
+						var val int
+						val, err = strconv.Atoi(c.Val())
+						if err != nil || val < 0 {
+							return &Autodns{}, c.Errf("invalid zone_cache max age '%s'", c.Val())
+						}
+						maxAge = time.Duration(val) * time.Second
+					}
+					autodns.zoneCache = newZoneCache(maxAge)
+					logger.Info("Zone cache enabled, max age ", maxAge)
+				case "authority.ns":
+					autodns.AuthorityNS = true
+					logger.Info("Apex NS in authority section enabled")
+				case "acme.require_owner":
+					autodns.AcmeRequireOwner = true
+					logger.Info("ACME require owner enabled")
+				case "acme.admin_network":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Autodns{}, c.ArgErr()
+					}
+					for _, ip := range args {
+						ip = strings.TrimSpace(ip)
+						_, ipnet, err := net.ParseCIDR(ip)
+						if err != nil {
+							logger.Info("Error: ", err)
+							return &Autodns{}, c.ArgErr()
+						}
+						logger.Info("ACME Admin Network: ", ip)
+						autodns.AcmeAdminNetworks = append(autodns.AcmeAdminNetworks, *ipnet)
+					}
+				case "any.response":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					switch c.Val() {
+					case anyResponseHinfo, anyResponseRRset:
+						autodns.AnyResponse = c.Val()
+					default:
+						return &Autodns{}, c.Errf("any.response must be %s or %s", anyResponseHinfo, anyResponseRRset)
+					}
+				case "any.full":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Autodns{}, c.ArgErr()
+					}
+					for _, ip := range args {
+						ip = strings.TrimSpace(ip)
+						_, ipnet, err := net.ParseCIDR(ip)
+						if err != nil {
+							logger.Info("Error: ", err)
+							return &Autodns{}, c.ArgErr()
+						}
+						logger.Info("ANY Full Network: ", ip)
+						autodns.AnyFullNetworks = append(autodns.AnyFullNetworks, *ipnet)
+					}
+				case "status.network":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Autodns{}, c.ArgErr()
+					}
+					for _, ip := range args {
+						ip = strings.TrimSpace(ip)
+						_, ipnet, err := net.ParseCIDR(ip)
+						if err != nil {
+							logger.Info("Error: ", err)
+							return &Autodns{}, c.ArgErr()
+						}
+						logger.Info("Status Network: ", ip)
+						autodns.StatusNetworks = append(autodns.StatusNetworks, *ipnet)
+					}
+				case "chaos.network":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return &Autodns{}, c.ArgErr()
+					}
+					for _, ip := range args {
+						ip = strings.TrimSpace(ip)
+						_, ipnet, err := net.ParseCIDR(ip)
+						if err != nil {
+							logger.Info("Error: ", err)
+							return &Autodns{}, c.ArgErr()
+						}
+						logger.Info("CHAOS Network: ", ip)
+						autodns.ChaosNetworks = append(autodns.ChaosNetworks, *ipnet)
+					}
+				case "dyndns.listen":
+					if !c.NextArg() {
+						return &Autodns{}, c.ArgErr()
+					}
+					autodns.DyndnsListen = c.Val()
+					logger.Info("DynDNS2 listen: ", autodns.DyndnsListen)
 				default:
 					if c.Val() != "}" {
 						return &Autodns{}, c.Errf("unknown configuration property '%s'", c.Val())
@@ -208,6 +486,10 @@ func redisSetup(c *caddy.Controller) (*Autodns, error) {
 
 		}
 
+		if autodns.AcmednsListen != "" && autodns.AcmednsZone == "" {
+			return &Autodns{}, c.Err("acmedns.listen requires acmedns.zone")
+		}
+
 		autodns.Connect()
 		autodns.LoadZones()
 
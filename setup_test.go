@@ -249,6 +249,7 @@ func TestRedisSetupDirectives(t *testing.T) {
 		connect_timeout 500
 		read_timeout 250
 		autocreate newzone.example
+		authority.ns
 	}`, mr.Addr())
 
 	c := caddy.NewTestController("dns", corefile)
@@ -265,4 +266,7 @@ func TestRedisSetupDirectives(t *testing.T) {
 	if len(a.AutoCreate) != 1 || a.AutoCreate[0] != "newzone.example" {
 		t.Fatalf("AutoCreate = %v", a.AutoCreate)
 	}
+	if !a.AuthorityNS {
+		t.Fatal("authority.ns not enabled")
+	}
 }
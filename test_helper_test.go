@@ -3,7 +3,6 @@ package autodns
 import (
 	"net"
 	"testing"
-	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
@@ -24,9 +23,8 @@ func newTestAutodns(t *testing.T, opts ...func(*Autodns)) (*Autodns, *miniredis.
 
 	mr := miniredis.RunT(t)
 	a := &Autodns{
-		redisAddress:   mr.Addr(),
-		Ttl:            300,
-		LastZoneUpdate: time.Now(),
+		redisAddress: mr.Addr(),
+		Ttl:          300,
 	}
 	a.Connect()
 
@@ -56,7 +54,7 @@ func seedExampleZone(t *testing.T, mr *miniredis.Miniredis, a *Autodns) {
 		mr.HSet(zoneKey, field, value)
 	}
 
-	a.Zones = []string{exampleZone}
+	a.setZones([]string{exampleZone})
 }
 
 type remoteAddrWriter struct {
@@ -0,0 +1,71 @@
+package autodns
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// Transfer implements the transfer.Transferer interface, so zone transfers
+// go through the transfer plugin and its ACLs. A serial of 0 asks for a full
+// transfer; otherwise the journal is used when it reaches back far enough.
+func (autodns *Autodns) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if !slices.Contains(autodns.zones(), zone) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	z, err := autodns.load(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []dns.RR
+	if serial != 0 {
+		records, _ = autodns.IXFR(z, serial)
+	}
+	if records == nil {
+		if records, err = autodns.AXFR(z); err != nil {
+			return nil, err
+		}
+	}
+
+	ch := make(chan []dns.RR)
+	go func() {
+		defer close(ch)
+		for len(records) > 0 {
+			n := min(len(records), transferBatch)
+			ch <- records[:n]
+			records = records[n:]
+		}
+	}()
+	return ch, nil
+}
+
+// transferBatch is the number of records handed to the transfer plugin at a
+// time; it packs them into envelopes itself.
+const transferBatch = 500
+
+// useTransfer hooks autodns up to the transfer plugin of its server block,
+// which sends the NOTIFYs for its to directives, and announces every served
+// zone once, as secondaries may have missed changes while we were down.
+func (autodns *Autodns) useTransfer(t *transfer.Transfer) {
+	autodns.transfer.Store(t)
+	for _, zone := range autodns.zones() {
+		autodns.notifyTransfer(zone)
+	}
+}
+
+// notifyTransfer has the transfer plugin NOTIFY the secondaries listed in its
+// to directives, retried like the notify targets.
+func (autodns *Autodns) notifyTransfer(zone string) {
+	t := autodns.transfer.Load()
+	if t == nil {
+		return
+	}
+	go autodns.retryNotify(zone, "transfer destinations", notifyRetryInterval, func() error {
+		return t.Notify(zone)
+	})
+}
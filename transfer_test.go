@@ -0,0 +1,96 @@
+package autodns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+)
+
+// transferWriter keeps every message of a transfer.
+type transferWriter struct {
+	test.ResponseWriter
+	msgs []*dns.Msg
+}
+
+func (w *transferWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+// transferPlugin sets up the transfer plugin from corefile in front of a.
+func transferPlugin(t *testing.T, a *Autodns, corefile string) *transfer.Transfer {
+	t.Helper()
+
+	c := caddy.NewTestController("dns", corefile)
+	setupTransfer, err := caddy.DirectiveAction("dns", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setupTransfer(c); err != nil {
+		t.Fatalf("transfer setup: %v", err)
+	}
+	tr := dnsserver.GetConfig(c).Plugin[0](a).(*transfer.Transfer)
+	tr.Transferers = []transfer.Transferer{a}
+	return tr
+}
+
+func TestTransferNotAuthoritative(t *testing.T) {
+	a, _ := prepareServeDNS(t)
+
+	if _, err := a.Transfer("example.org.", 0); err != transfer.ErrNotAuthoritative {
+		t.Fatalf("Transfer(example.org.) error = %v, want ErrNotAuthoritative", err)
+	}
+	if _, err := a.Transfer("EXAMPLE.net", 0); err != nil {
+		t.Fatalf("Transfer(EXAMPLE.net) error = %v", err)
+	}
+}
+
+func TestServeDNSRefusesTransfer(t *testing.T) {
+	a, _ := prepareServeDNS(t)
+
+	for _, qtype := range []uint16{dns.TypeAXFR, dns.TypeIXFR} {
+		resp := serveDNS(t, a, "10.240.0.1", exampleZone, qtype)
+		if resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+			t.Fatalf("%s: rcode %s with %d answers, want REFUSED", dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		}
+	}
+}
+
+func TestTransferPluginACL(t *testing.T) {
+	a, _ := prepareServeDNS(t)
+	tr := transferPlugin(t, a, "transfer example.net {\n to 10.240.0.1\n}")
+
+	m := new(dns.Msg)
+	m.SetAxfr(exampleZone)
+
+	w := &transferWriter{ResponseWriter: test.ResponseWriter{TCP: true}}
+	if _, err := tr.ServeDNS(context.Background(), w, m); err != nil {
+		t.Fatalf("ServeDNS error: %v", err)
+	}
+	var records []dns.RR
+	for _, msg := range w.msgs {
+		records = append(records, msg.Answer...)
+	}
+	if len(records) < 4 {
+		t.Fatalf("AXFR has %d records", len(records))
+	}
+	if _, ok := records[0].(*dns.SOA); !ok {
+		t.Fatalf("AXFR starts with %v", records[0])
+	}
+	if _, ok := records[len(records)-1].(*dns.SOA); !ok {
+		t.Fatalf("AXFR ends with %v", records[len(records)-1])
+	}
+
+	w = &transferWriter{ResponseWriter: test.ResponseWriter{TCP: true, RemoteIP: "10.240.0.2"}}
+	if _, err := tr.ServeDNS(context.Background(), w, m); err != nil {
+		t.Fatalf("ServeDNS error: %v", err)
+	}
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused || len(w.msgs[0].Answer) != 0 {
+		t.Fatalf("transfer to another client = %v, want REFUSED", w.msgs)
+	}
+}
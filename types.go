@@ -1,10 +1,24 @@
 package autodns
 
-import "net"
+import (
+	"net"
+	"sync"
+	"time"
+)
 
 type Zone struct {
 	Name      string
 	Locations map[string]struct{}
+	Serial    uint32
+
+	treeOnce sync.Once
+	tree     *labelNode
+
+	// records memoizes the records read through this zone; loaded is set
+	// only on zones held by the zone cache
+	loaded    time.Time
+	recordsMu sync.Mutex
+	records   map[string]*Record
 }
 
 type Record struct {
@@ -16,6 +30,7 @@ type Record struct {
 	MX    []MX_Record    `json:"mx,omitempty"`
 	SRV   []SRV_Record   `json:"srv,omitempty"`
 	CAA   []CAA_Record   `json:"caa,omitempty"`
+	DS    []DS_Record    `json:"ds,omitempty"`
 	SOA   SOA_Record     `json:"soa,omitempty"`
 }
 
@@ -30,8 +45,9 @@ type AAAA_Record struct {
 }
 
 type TXT_Record struct {
-	Ttl  uint32 `json:"ttl,omitempty"`
-	Text string `json:"text"`
+	Ttl       uint32 `json:"ttl,omitempty"`
+	Text      string `json:"text"`
+	Published int64  `json:"published,omitempty"`
 }
 
 type CNAME_Record struct {
@@ -73,7 +89,16 @@ type SOA_Record struct {
 }
 
 type CAA_Record struct {
+	Ttl   uint32 `json:"ttl,omitempty"`
 	Flag  uint8  `json:"flag"`
 	Tag   string `json:"tag"`
 	Value string `json:"value"`
 }
+
+type DS_Record struct {
+	Ttl        uint32 `json:"ttl,omitempty"`
+	KeyTag     uint16 `json:"keytag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digesttype"`
+	Digest     string `json:"digest"`
+}
@@ -0,0 +1,318 @@
+package autodns
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// zoneCache keeps parsed zones in memory between queries. Entries are
+// dropped when Redis reports a change to the zone hash through keyspace
+// notifications, when this instance writes to the zone itself, or once they
+// are older than maxAge. The cache is only consulted while the notification
+// subscription is up; without it every query goes to Redis as before.
+type zoneCache struct {
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	zones map[string]*Zone
+	gen   uint64
+
+	active        atomic.Bool
+	misconfigured atomic.Bool
+	stop          chan struct{}
+	conn          redisCon.Conn
+}
+
+const (
+	defaultZoneCacheMaxAge   = 5 * time.Minute
+	zoneCachePingInterval    = 30 * time.Second
+	zoneCacheRetryInterval   = time.Second
+	keyspaceChannelPrefix    = "__keyspace@"
+	keyspaceChannelSeparator = "__:"
+)
+
+func newZoneCache(maxAge time.Duration) *zoneCache {
+	return &zoneCache{maxAge: maxAge, zones: make(map[string]*Zone)}
+}
+
+// lookup returns the cached zone, or nil with the generation a caller must
+// pass to store once it has loaded the zone from Redis.
+func (c *zoneCache) lookup(name string) (*Zone, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.zones[name]; ok {
+		if c.maxAge <= 0 || time.Since(z.loaded) < c.maxAge {
+			return z, c.gen
+		}
+		delete(c.zones, name)
+	}
+	return nil, c.gen
+}
+
+// store caches z unless an invalidation happened since gen was handed out,
+// in which case z may already be stale.
+func (c *zoneCache) store(z *Zone, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	z.loaded = time.Now()
+	z.records = make(map[string]*Record)
+	c.zones[z.Name] = z
+}
+
+func (c *zoneCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.zones, name)
+}
+
+// invalidateSerial drops name unless the cached zone already carries serial.
+// A zone that is not cached still bumps the generation, as a load in flight
+// may have read the old serial.
+func (c *zoneCache) invalidateSerial(name string, serial uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if z, ok := c.zones[name]; ok && z.Serial == serial {
+		return
+	}
+	c.gen++
+	delete(c.zones, name)
+}
+
+func (c *zoneCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.zones = make(map[string]*Zone)
+}
+
+// cachedRecord returns the decoded record for label if it was already read
+// through z, by this query or, for cached zones, an earlier one.
+func (z *Zone) cachedRecord(label string) (*Record, bool) {
+	if z.records == nil {
+		return nil, false
+	}
+	z.recordsMu.Lock()
+	defer z.recordsMu.Unlock()
+	r, ok := z.records[label]
+	return r, ok
+}
+
+func (z *Zone) cacheRecord(label string, r *Record) {
+	if z.records == nil {
+		return
+	}
+	z.recordsMu.Lock()
+	defer z.recordsMu.Unlock()
+	z.records[label] = r
+}
+
+// invalidateZone drops zone from the cache after a local write, so this
+// instance sees its own changes without waiting for the notification.
+func (autodns *Autodns) invalidateZone(zone string) {
+	if autodns.zoneCache != nil {
+		autodns.zoneCache.invalidate(zone)
+	}
+}
+
+// keyspacePattern is the PSUBSCRIBE pattern matching zone hash keys in any
+// database.
+func (autodns *Autodns) keyspacePattern() string {
+	return keyspaceChannelPrefix + "*" + keyspaceChannelSeparator +
+		escapeGlob(autodns.keyPrefix) + "*" + escapeGlob(autodns.keySuffix)
+}
+
+// keyspaceKey returns the key a keyspace notification channel reports on.
+func keyspaceKey(channel string) (string, bool) {
+	if !strings.HasPrefix(channel, keyspaceChannelPrefix) {
+		return "", false
+	}
+	i := strings.Index(channel, keyspaceChannelSeparator)
+	if i < 0 {
+		return "", false
+	}
+	return channel[i+len(keyspaceChannelSeparator):], true
+}
+
+// keyspaceZone maps a keyspace notification channel back to the zone it
+// reports on. Plugin state keys and foreign keys return false.
+func (autodns *Autodns) keyspaceZone(channel string) (string, bool) {
+	key, ok := keyspaceKey(channel)
+	if !ok || !strings.HasPrefix(key, autodns.keyPrefix) || !strings.HasSuffix(key, autodns.keySuffix) {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(key, autodns.keyPrefix), autodns.keySuffix)
+	if !isZoneKeyName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// checkKeyspaceEvents reports whether Redis publishes the hash and generic
+// keyspace events the cache relies on, and warns once when it does not. A
+// server that refuses CONFIG GET, as many managed ones do, is trusted to be
+// configured.
+func (autodns *Autodns) checkKeyspaceEvents() bool {
+	conn := autodns.Pool.Get()
+	defer conn.Close()
+
+	values, err := redisCon.Strings(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil || len(values) != 2 {
+		return true
+	}
+	flags := values[1]
+	if strings.Contains(flags, "K") && (strings.Contains(flags, "A") ||
+		(strings.Contains(flags, "h") && strings.Contains(flags, "g"))) {
+		autodns.zoneCache.misconfigured.Store(false)
+		return true
+	}
+	if !autodns.zoneCache.misconfigured.Swap(true) {
+		logger.Warningf("zone_cache: redis notify-keyspace-events is %q, set it to include \"Khg\"; "+
+			"the cache stays off until then", flags)
+	}
+	return false
+}
+
+// activateZoneCache switches the cache on when Redis publishes the events
+// that invalidate it, and off when it stopped doing so. It runs when the
+// subscription is set up and on every pong after that.
+func (autodns *Autodns) activateZoneCache() {
+	c := autodns.zoneCache
+	if !autodns.checkKeyspaceEvents() {
+		c.active.Store(false)
+		c.flush()
+		return
+	}
+	if !c.active.Load() {
+		c.flush()
+		c.active.Store(true)
+	}
+}
+
+// subscribeZoneChanges holds one keyspace subscription until it fails or the
+// cache is stopped. The cache is active only while the subscription is up.
+func (autodns *Autodns) subscribeZoneChanges(stop chan struct{}) {
+	c := autodns.zoneCache
+	conn, err := autodns.Pool.Dial()
+	if err != nil {
+		logger.Warning("zone_cache: error connecting to redis: ", err)
+		return
+	}
+
+	c.mu.Lock()
+	select {
+	case <-stop:
+		c.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	psc := redisCon.PubSubConn{Conn: conn}
+	defer func() {
+		c.active.Store(false)
+		c.flush()
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		psc.Close()
+	}()
+	if err := psc.PSubscribe(autodns.keyspacePattern()); err != nil {
+		logger.Warning("zone_cache: error subscribing to keyspace events: ", err)
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(zoneCachePingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				psc.Ping("")
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * zoneCachePingInterval).(type) {
+		case redisCon.Subscription:
+			if v.Kind == "psubscribe" {
+				logger.Info("zone_cache: watching ", v.Channel)
+				autodns.activateZoneCache()
+			}
+		case redisCon.Pong:
+			autodns.activateZoneCache()
+		case redisCon.Message:
+			if zone, ok := autodns.keyspaceZone(v.Channel); ok {
+				c.invalidate(zone)
+			} else if key, _ := keyspaceKey(v.Channel); key == autodns.zoneRegistryKey() {
+				autodns.requestZoneRefresh()
+			} else if key == autodns.zoneSerialKey() {
+				autodns.checkSerials()
+			}
+		case error:
+			select {
+			case <-stop:
+			default:
+				logger.Warning("zone_cache: keyspace subscription lost: ", v)
+			}
+			return
+		}
+	}
+}
+
+func (autodns *Autodns) startZoneCache() error {
+	c := autodns.zoneCache
+	c.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		for {
+			autodns.subscribeZoneChanges(stop)
+			select {
+			case <-stop:
+				return
+			case <-time.After(zoneCacheRetryInterval):
+			}
+		}
+	}(c.stop)
+	return nil
+}
+
+func (autodns *Autodns) stopZoneCache() error {
+	c := autodns.zoneCache
+	if c == nil || c.stop == nil {
+		return nil
+	}
+	c.mu.Lock()
+	close(c.stop)
+	c.stop = nil
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	return nil
+}
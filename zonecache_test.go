@@ -0,0 +1,246 @@
+package autodns
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func startTestZoneCache(t *testing.T, a *Autodns, maxAge time.Duration) {
+	t.Helper()
+
+	a.zoneCache = newZoneCache(maxAge)
+	if err := a.startZoneCache(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.stopZoneCache() })
+	waitFor(t, "zone cache subscription", a.zoneCache.active.Load)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func host1Address(t *testing.T, a *Autodns) string {
+	t.Helper()
+
+	resp := serveDNS(t, a, "8.8.8.8", "host1.example.net.", dns.TypeA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("host1 A answers = %v", resp.Answer)
+	}
+	return resp.Answer[0].(*dns.A).A.String()
+}
+
+func TestZoneCacheKeyspaceInvalidation(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	startTestZoneCache(t, a, time.Hour)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	if got := host1Address(t, a); got != "5.5.5.5" {
+		t.Fatalf("host1 = %s, want 5.5.5.5", got)
+	}
+	if a.stats.cacheMisses.Load() != 1 {
+		t.Fatalf("cache misses = %d, want 1", a.stats.cacheMisses.Load())
+	}
+
+	// miniredis does not emit keyspace events, so the write goes unnoticed
+	// until one is published by hand.
+	mr.HSet(zoneKey, "host1", `{"a":[{"ttl":300, "ip":"6.6.6.6"}]}`)
+	if got := host1Address(t, a); got != "5.5.5.5" {
+		t.Fatalf("host1 = %s, want cached 5.5.5.5", got)
+	}
+	if a.stats.cacheHits.Load() == 0 {
+		t.Fatal("expected cache hits")
+	}
+
+	mr.Publish("__keyspace@0__:"+zoneKey, "hset")
+	waitFor(t, "invalidation", func() bool { return host1Address(t, a) == "6.6.6.6" })
+}
+
+func TestZoneCacheExternalSerialBump(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	startTestZoneCache(t, a, time.Hour)
+
+	before := soaSerial(t, a)
+	mr.HIncr(a.zoneSerialKey(), exampleZone, 1)
+	if got := soaSerial(t, a); got != before {
+		t.Fatalf("serial = %d, want cached %d", got, before)
+	}
+
+	mr.Publish("__keyspace@0__:"+a.zoneSerialKey(), "hincrby")
+	waitFor(t, "serial invalidation", func() bool { return soaSerial(t, a) == before+1 })
+}
+
+func TestZoneCacheLocalWrites(t *testing.T) {
+	a, _ := prepareServeDNS(t)
+	startTestZoneCache(t, a, time.Hour)
+
+	if z, _ := a.load(exampleZone); keyExists("newhost", z) {
+		t.Fatal("newhost exists before registration")
+	}
+	if err := a.AddARecord(exampleZone, "newhost", "100.64.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	resp := serveDNS(t, a, "8.8.8.8", "newhost.example.net.", dns.TypeA)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "100.64.0.5" {
+		t.Fatalf("newhost answers = %v", resp.Answer)
+	}
+
+	if err := a.DeleteAcmeTXTRecord(exampleZone, "newhost"); err != nil {
+		t.Fatal(err)
+	}
+	if z, _ := a.load(exampleZone); keyExists("newhost", z) {
+		t.Fatal("newhost still cached after delete")
+	}
+}
+
+func TestZoneCacheMaxAge(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	startTestZoneCache(t, a, 50*time.Millisecond)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	host1Address(t, a)
+	mr.HSet(zoneKey, "host1", `{"a":[{"ttl":300, "ip":"6.6.6.6"}]}`)
+	waitFor(t, "expiry", func() bool { return host1Address(t, a) == "6.6.6.6" })
+}
+
+func TestZoneCacheInactiveWithoutSubscription(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	a.zoneCache = newZoneCache(time.Hour)
+	zoneKey := a.keyPrefix + exampleZone + a.keySuffix
+
+	host1Address(t, a)
+	mr.HSet(zoneKey, "host1", `{"a":[{"ttl":300, "ip":"6.6.6.6"}]}`)
+	if got := host1Address(t, a); got != "6.6.6.6" {
+		t.Fatalf("host1 = %s, want 6.6.6.6 straight from redis", got)
+	}
+}
+
+func TestZoneCacheInactiveWithoutKeyspaceEvents(t *testing.T) {
+	a, mr := prepareServeDNS(t)
+	var flags atomic.Value
+	flags.Store("")
+	err := mr.Server().Register("CONFIG", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(2)
+		c.WriteBulk("notify-keyspace-events")
+		c.WriteBulk(flags.Load().(string))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.zoneCache = newZoneCache(time.Hour)
+	if err := a.startZoneCache(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.stopZoneCache() })
+	waitFor(t, "configuration check", a.zoneCache.misconfigured.Load)
+	if a.zoneCache.active.Load() {
+		t.Fatal("cache active without keyspace events")
+	}
+
+	flags.Store("Khg")
+	a.activateZoneCache()
+	if !a.zoneCache.active.Load() {
+		t.Fatal("cache inactive with keyspace events enabled")
+	}
+	flags.Store("Ex")
+	a.activateZoneCache()
+	if a.zoneCache.active.Load() {
+		t.Fatal("cache still active after keyspace events were disabled")
+	}
+}
+
+func TestZoneCacheStaleStore(t *testing.T) {
+	c := newZoneCache(time.Hour)
+	_, gen := c.lookup(exampleZone)
+	c.invalidate(exampleZone)
+	c.store(&Zone{Name: exampleZone}, gen)
+	if z, _ := c.lookup(exampleZone); z != nil {
+		t.Fatal("zone loaded before an invalidation was cached")
+	}
+}
+
+func TestKeyspaceZone(t *testing.T) {
+	a := &Autodns{keyPrefix: "dns:", keySuffix: ":zone"}
+
+	tests := []struct {
+		channel string
+		want    string
+		ok      bool
+	}{
+		{channel: "__keyspace@0__:dns:example.net.:zone", want: "example.net.", ok: true},
+		{channel: "__keyspace@12__:dns:a.b.example.:zone", want: "a.b.example.", ok: true},
+		{channel: "__keyspace@0__:dns:_autodns:acmedns:zone"},
+		{channel: "__keyspace@0__:other:example.net.:zone"},
+		{channel: "__keyevent@0__:hset"},
+		{channel: "example.net."},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.channel, func(t *testing.T) {
+			got, ok := a.keyspaceZone(tc.channel)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("keyspaceZone(%q) = %q, %v, want %q, %v", tc.channel, got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+
+	if got, want := a.keyspacePattern(), "__keyspace@*__:dns:*:zone"; got != want {
+		t.Fatalf("keyspacePattern = %q, want %q", got, want)
+	}
+	glob := &Autodns{keyPrefix: "[dns]*"}
+	if got, want := glob.keyspacePattern(), `__keyspace@*__:\[dns\]\**`; got != want {
+		t.Fatalf("keyspacePattern = %q, want %q", got, want)
+	}
+}
+
+func TestZoneCacheSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	tests := []struct {
+		directive string
+		want      time.Duration
+		wantError bool
+	}{
+		{directive: "zone_cache", want: defaultZoneCacheMaxAge},
+		{directive: "zone_cache 30", want: 30 * time.Second},
+		{directive: "zone_cache soon", wantError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.directive, func(t *testing.T) {
+			corefile := fmt.Sprintf(`autodns {
+				address %s
+				%s
+			}`, mr.Addr(), tc.directive)
+			a, err := redisSetup(caddy.NewTestController("dns", corefile))
+			if tc.wantError {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("redisSetup error: %v", err)
+			}
+			if a.zoneCache == nil || a.zoneCache.maxAge != tc.want {
+				t.Fatalf("zoneCache = %+v, want max age %s", a.zoneCache, tc.want)
+			}
+		})
+	}
+}
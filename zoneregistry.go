@@ -0,0 +1,210 @@
+package autodns
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	redisCon "github.com/gomodule/redigo/redis"
+)
+
+// zoneRegistryKey is a hash listing the served zones: one field per zone,
+// holding zoneMeta as JSON.
+const zoneRegistryKey = "_autodns:zones"
+
+const (
+	defaultZoneRefresh = 10 * time.Minute
+	zoneScanCount      = 1000
+)
+
+type zoneMeta struct {
+	Created int64 `json:"created"`
+}
+
+// pluginStatePrefix starts every key the plugin keeps for itself.
+const pluginStatePrefix = "_autodns:"
+
+// isZoneKeyName reports whether a key name, with prefix and suffix removed,
+// names a zone hash. Zone keys always end with a dot; plugin state keys,
+// some of which embed a zone name, start with pluginStatePrefix.
+func isZoneKeyName(name string) bool {
+	return strings.HasSuffix(name, ".") && !strings.HasPrefix(name, pluginStatePrefix)
+}
+
+// zoneSnapshot is the zone list handed to query goroutines. It is never
+// modified after being published; a refresh swaps in a new one.
+type zoneSnapshot struct {
+	zones   []string
+	ignored []string
+	updated time.Time
+}
+
+func (autodns *Autodns) zoneRegistryKey() string {
+	return autodns.keyPrefix + zoneRegistryKey + autodns.keySuffix
+}
+
+// zones returns the zones of the current snapshot. Callers must not modify
+// the returned slice.
+func (autodns *Autodns) zones() []string {
+	if s := autodns.zoneSnapshot.Load(); s != nil {
+		return s.zones
+	}
+	return nil
+}
+
+func (autodns *Autodns) lastZoneUpdate() time.Time {
+	if s := autodns.zoneSnapshot.Load(); s != nil {
+		return s.updated
+	}
+	return time.Time{}
+}
+
+func (autodns *Autodns) setZones(zones []string) {
+	autodns.zoneSnapshot.Store(&zoneSnapshot{zones: zones, updated: time.Now()})
+}
+
+// zoneAllowed reports whether zone lies within the server block origins and
+// passes the zones allow/deny globs. Deny wins over allow; an empty allow
+// list allows every zone.
+func (autodns *Autodns) zoneAllowed(zone string) bool {
+	if len(autodns.Origins) > 0 && plugin.Zones(autodns.Origins).Matches(zone) == "" {
+		return false
+	}
+	if matchesZoneGlob(zone, autodns.ZonesDeny) {
+		return false
+	}
+	return len(autodns.ZonesAllow) == 0 || matchesZoneGlob(zone, autodns.ZonesAllow)
+}
+
+func matchesZoneGlob(zone string, globs []string) bool {
+	zone = strings.ToLower(zone)
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, zone); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// servedZones splits zones into the sorted lists of zones to serve and zones
+// to ignore.
+func (autodns *Autodns) servedZones(zones []string) (served, ignored []string) {
+	for _, zone := range zones {
+		if autodns.zoneAllowed(zone) {
+			served = append(served, zone)
+		} else {
+			ignored = append(ignored, zone)
+		}
+	}
+	sort.Strings(served)
+	sort.Strings(ignored)
+	return served, ignored
+}
+
+func (autodns *Autodns) registerZone(conn redisCon.Conn, zone string) error {
+	meta, err := json.Marshal(zoneMeta{Created: time.Now().Unix()})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSETNX", autodns.zoneRegistryKey(), zone, meta)
+	return err
+}
+
+// registeredZones reads the zone registry. A missing registry is reported
+// with ok=false so the caller can migrate existing zone hashes into it.
+func (autodns *Autodns) registeredZones(conn redisCon.Conn) (zones []string, ok bool, err error) {
+	exists, err := redisCon.Bool(conn.Do("EXISTS", autodns.zoneRegistryKey()))
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	zones, err = redisCon.Strings(conn.Do("HKEYS", autodns.zoneRegistryKey()))
+	return zones, true, err
+}
+
+// scanZones walks the keyspace with SCAN and returns every key that looks
+// like a zone hash. It is only used to build the registry for databases
+// written before it existed.
+func (autodns *Autodns) scanZones(conn redisCon.Conn) ([]string, error) {
+	var (
+		zones  []string
+		cursor = "0"
+	)
+	pattern := escapeGlob(autodns.keyPrefix) + "*" + escapeGlob(autodns.keySuffix)
+	for {
+		values, err := redisCon.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", zoneScanCount))
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != 2 {
+			return nil, errors.New("unexpected SCAN reply")
+		}
+		if cursor, err = redisCon.String(values[0], nil); err != nil {
+			return nil, err
+		}
+		keys, err := redisCon.Strings(values[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !strings.HasPrefix(key, autodns.keyPrefix) || !strings.HasSuffix(key, autodns.keySuffix) {
+				continue
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(key, autodns.keyPrefix), autodns.keySuffix)
+			if isZoneKeyName(name) {
+				zones = append(zones, name)
+			}
+		}
+		if cursor == "0" {
+			return zones, nil
+		}
+	}
+}
+
+func (autodns *Autodns) startZoneRefresh() error {
+	autodns.zoneRefreshStop = make(chan struct{})
+	autodns.zoneRefreshNow = make(chan struct{}, 1)
+	go func(stop, refresh chan struct{}) {
+		ticker := time.NewTicker(autodns.zoneRefreshInterval())
+		defer ticker.Stop()
+		autodns.checkSerials()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			case <-refresh:
+			}
+			autodns.LoadZones()
+			autodns.checkSerials()
+		}
+	}(autodns.zoneRefreshStop, autodns.zoneRefreshNow)
+	return nil
+}
+
+func (autodns *Autodns) stopZoneRefresh() error {
+	if autodns.zoneRefreshStop != nil {
+		close(autodns.zoneRefreshStop)
+		autodns.zoneRefreshStop = nil
+	}
+	return nil
+}
+
+// requestZoneRefresh asks the background refresher to reload the registry
+// without waiting for the next tick.
+func (autodns *Autodns) requestZoneRefresh() {
+	select {
+	case autodns.zoneRefreshNow <- struct{}{}:
+	default:
+	}
+}
+
+func (autodns *Autodns) zoneRefreshInterval() time.Duration {
+	if autodns.ZoneRefresh <= 0 {
+		return defaultZoneRefresh
+	}
+	return autodns.ZoneRefresh
+}
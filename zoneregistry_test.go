@@ -0,0 +1,278 @@
+package autodns
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestLoadZonesRegistry(t *testing.T) {
+	a, mr := newTestAutodns(t)
+	mr.HSet(a.zoneRegistryKey(), exampleZone, `{"created":1700000000}`)
+	mr.HSet(a.keyPrefix+exampleZone+a.keySuffix, "host1", `{"a":[{"ttl":300,"ip":"1.2.3.4"}]}`)
+	// a hash that looks like a zone but was never registered
+	mr.HSet(a.keyPrefix+"stray.example."+a.keySuffix, "host1", `{"a":[{"ttl":300,"ip":"1.2.3.4"}]}`)
+
+	a.LoadZones()
+	if got := a.zones(); !slices.Equal(got, []string{exampleZone}) {
+		t.Fatalf("zones = %v, want [%q]", got, exampleZone)
+	}
+	if a.lastZoneUpdate().IsZero() {
+		t.Fatal("last zone update not set")
+	}
+}
+
+func TestLoadZonesMigratesExistingZones(t *testing.T) {
+	a, mr := newTestAutodns(t, func(a *Autodns) {
+		a.keyPrefix = "dns:"
+		a.keySuffix = ":zone"
+	})
+	for _, zone := range []string{"example.org.", exampleZone} {
+		mr.HSet(a.keyPrefix+zone+a.keySuffix, "@", `{"soa":{"ns":"ns1.`+zone+`"}}`)
+	}
+	mr.HSet(a.dyndnsKey(), "router", `{}`)
+	mr.Set("dns:unrelated.", "x")
+	mr.Set(a.journalKey(exampleZone), "x")
+
+	a.LoadZones()
+	want := []string{exampleZone, "example.org."}
+	if got := a.zones(); !slices.Equal(got, want) {
+		t.Fatalf("zones = %v, want %v", got, want)
+	}
+	for _, zone := range want {
+		var meta zoneMeta
+		if err := json.Unmarshal([]byte(mr.HGet(a.zoneRegistryKey(), zone)), &meta); err != nil || meta.Created == 0 {
+			t.Fatalf("registry entry for %s = %q", zone, mr.HGet(a.zoneRegistryKey(), zone))
+		}
+	}
+	if keys, _ := mr.HKeys(a.zoneRegistryKey()); len(keys) != 2 {
+		t.Fatalf("registry = %v, want only the zones", keys)
+	}
+
+	// once the registry exists, only registered zones are served
+	mr.HSet(a.keyPrefix+"late.example."+a.keySuffix, "@", `{}`)
+	a.LoadZones()
+	if got := a.zones(); !slices.Equal(got, want) {
+		t.Fatalf("zones after migration = %v, want %v", got, want)
+	}
+}
+
+func TestCreateZoneRegisters(t *testing.T) {
+	a, mr := newTestAutodns(t)
+	if err := a.CreateZone("test.com"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.HGet(a.zoneRegistryKey(), "test.com.") == "" {
+		t.Fatal("created zone missing from registry")
+	}
+}
+
+func TestLoadZonesKeepsSnapshotOnError(t *testing.T) {
+	a, mr := newTestAutodns(t)
+	mr.HSet(a.zoneRegistryKey(), exampleZone, `{}`)
+	a.LoadZones()
+	before := a.lastZoneUpdate()
+
+	mr.SetError("LOADING")
+	a.LoadZones()
+	mr.SetError("")
+
+	if got := a.zones(); !slices.Equal(got, []string{exampleZone}) {
+		t.Fatalf("zones = %v after failed refresh", got)
+	}
+	if !a.lastZoneUpdate().Equal(before) {
+		t.Fatal("failed refresh replaced the snapshot")
+	}
+}
+
+func TestZoneRefresh(t *testing.T) {
+	a, mr := prepareServeDNS(t, func(a *Autodns) {
+		a.ZoneRefresh = 20 * time.Millisecond
+	})
+	mr.HSet(a.zoneRegistryKey(), exampleZone, `{}`)
+	if err := a.startZoneRefresh(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.stopZoneRefresh() })
+
+	mr.HSet(a.zoneRegistryKey(), "example.org.", `{}`)
+	waitFor(t, "refresh", func() bool { return slices.Contains(a.zones(), "example.org.") })
+
+	// queries keep being answered from the snapshot while it is swapped
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				resp := serveDNS(t, a, "8.8.8.8", "host1.example.net.", dns.TypeA)
+				if len(resp.Answer) != 1 {
+					t.Errorf("host1 answers = %v", resp.Answer)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestZoneRefreshOnRegistryEvent(t *testing.T) {
+	a, mr := prepareServeDNS(t, func(a *Autodns) {
+		a.ZoneRefresh = time.Hour
+	})
+	mr.HSet(a.zoneRegistryKey(), exampleZone, `{}`)
+	if err := a.startZoneRefresh(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.stopZoneRefresh() })
+	startTestZoneCache(t, a, time.Hour)
+
+	mr.HSet(a.zoneRegistryKey(), "example.org.", `{}`)
+	mr.Publish("__keyspace@0__:"+a.zoneRegistryKey(), "hset")
+	waitFor(t, "registry refresh", func() bool { return slices.Contains(a.zones(), "example.org.") })
+}
+
+func TestZoneRefreshSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	tests := []struct {
+		directive string
+		want      time.Duration
+		wantError bool
+	}{
+		{directive: "zone_refresh 30", want: 30 * time.Second},
+		{directive: "zone_refresh 0", wantError: true},
+		{directive: "zone_refresh", wantError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.directive, func(t *testing.T) {
+			corefile := fmt.Sprintf(`autodns {
+				address %s
+				%s
+			}`, mr.Addr(), tc.directive)
+			a, err := redisSetup(caddy.NewTestController("dns", corefile))
+			if tc.wantError {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("redisSetup error: %v", err)
+			}
+			if a.zoneRefreshInterval() != tc.want {
+				t.Fatalf("zone refresh = %s, want %s", a.zoneRefreshInterval(), tc.want)
+			}
+		})
+	}
+}
+
+func TestZoneAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		allow   []string
+		deny    []string
+		zone    string
+		want    bool
+	}{
+		{name: "no restrictions", zone: "other.example.", want: true},
+		{name: "root origin", origins: []string{"."}, zone: "other.example.", want: true},
+		{name: "origin itself", origins: []string{exampleZone}, zone: exampleZone, want: true},
+		{name: "below origin", origins: []string{exampleZone}, zone: "sub.example.net.", want: true},
+		{name: "outside origin", origins: []string{exampleZone}, zone: "example.org.", want: false},
+		{name: "stray root key", origins: []string{exampleZone}, zone: ".", want: false},
+		{name: "second origin", origins: []string{exampleZone, "corp.internal."}, zone: "corp.internal.", want: true},
+		{name: "allow glob", allow: []string{"*.example.net."}, zone: "sub.example.net.", want: true},
+		{name: "allow glob miss", allow: []string{"*.example.net."}, zone: exampleZone, want: false},
+		{name: "deny glob", deny: []string{"team-*.example.net."}, zone: "team-a.example.net.", want: false},
+		{name: "deny wins", allow: []string{"*.example.net."}, deny: []string{"team-*.example.net."}, zone: "team-a.example.net.", want: false},
+		{name: "case insensitive", allow: []string{"*.example.net."}, zone: "SUB.Example.NET.", want: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &Autodns{Origins: tc.origins, ZonesAllow: tc.allow, ZonesDeny: tc.deny}
+			if got := a.zoneAllowed(tc.zone); got != tc.want {
+				t.Fatalf("zoneAllowed(%q) = %v, want %v", tc.zone, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadZonesRestricted(t *testing.T) {
+	a, mr := newTestAutodns(t, func(a *Autodns) {
+		a.Origins = []string{exampleZone, "corp.internal."}
+		a.ZonesDeny = []string{"legacy.*"}
+		a.AutoCreate = []string{"outside.example."}
+	})
+	for _, zone := range []string{exampleZone, "corp.internal.", "legacy.corp.internal.", "other-team.example.", "."} {
+		mr.HSet(a.zoneRegistryKey(), zone, `{}`)
+	}
+
+	a.LoadZones()
+	want := []string{"corp.internal.", exampleZone}
+	if got := a.zones(); !slices.Equal(got, want) {
+		t.Fatalf("zones = %v, want %v", got, want)
+	}
+	if mr.Exists("outside.example.") {
+		t.Fatal("autocreate wrote a zone outside the server block")
+	}
+}
+
+func TestZonesSetup(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	t.Run("origins and globs", func(t *testing.T) {
+		corefile := fmt.Sprintf(`autodns example.net corp.internal {
+			address %s
+			zones allow *.example.net corp.internal
+			zones deny legacy.*
+		}`, mr.Addr())
+		a, err := redisSetup(caddy.NewTestController("dns", corefile))
+		if err != nil {
+			t.Fatalf("redisSetup error: %v", err)
+		}
+		if want := []string{exampleZone, "corp.internal."}; !slices.Equal(a.Origins, want) {
+			t.Fatalf("Origins = %v, want %v", a.Origins, want)
+		}
+		if want := []string{"*.example.net.", "corp.internal."}; !slices.Equal(a.ZonesAllow, want) {
+			t.Fatalf("ZonesAllow = %v, want %v", a.ZonesAllow, want)
+		}
+		if want := []string{"legacy.*."}; !slices.Equal(a.ZonesDeny, want) {
+			t.Fatalf("ZonesDeny = %v, want %v", a.ZonesDeny, want)
+		}
+	})
+
+	t.Run("server block keys", func(t *testing.T) {
+		c := caddy.NewTestController("dns", fmt.Sprintf("autodns {\naddress %s\n}", mr.Addr()))
+		c.ServerBlockKeys = []string{"example.org:53"}
+		a, err := redisSetup(c)
+		if err != nil {
+			t.Fatalf("redisSetup error: %v", err)
+		}
+		if want := []string{"example.org."}; !slices.Equal(a.Origins, want) {
+			t.Fatalf("Origins = %v, want %v", a.Origins, want)
+		}
+	})
+
+	for _, directive := range []string{"zones", "zones allow", "zones permit *.example.net", "zones deny [bad"} {
+		t.Run(directive, func(t *testing.T) {
+			corefile := fmt.Sprintf(`autodns {
+				address %s
+				%s
+			}`, mr.Addr(), directive)
+			if _, err := redisSetup(caddy.NewTestController("dns", corefile)); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+}